@@ -0,0 +1,332 @@
+package antipaste
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"github.com/cmars/go.crypto/openpgp"
+	pgperrors "github.com/cmars/go.crypto/openpgp/errors"
+	"github.com/cmars/go.crypto/openpgp/packet"
+)
+
+var agentTtl = agentFlags.Duration("ttl", 10 * time.Minute, "How long the agent keeps keys unlocked")
+
+// Holds unlocked secret keys between antipaste invocations, and decrypts
+// session keys with them on request. Clients never see the secret keys.
+type Agent struct {
+	pgp *Pgp
+	ttl time.Duration
+	// When each unlocked key is locked again, by fingerprint
+	expires map[string]time.Time
+	mu sync.Mutex
+}
+
+type AgentDecryptArgs struct {
+	// Raw public-key encrypted session key packets from a message
+	EncryptedKeys [][]byte
+}
+
+type AgentDecryptReply struct {
+	CipherFunc uint8
+	Key []byte
+	// Fingerprints of secret keys that could decrypt the session key
+	// once unlocked, if none are unlocked already
+	Locked []string
+}
+
+type AgentUnlockArgs struct {
+	Fingerprint string
+	Passphrase []byte
+}
+
+func agentSocket() (string, error) {
+	basepath, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(basepath, "agent.sock"), nil
+}
+
+func NewAgent(pgp *Pgp, ttl time.Duration) *Agent {
+	return &Agent{ pgp: pgp, ttl: ttl, expires: make(map[string]time.Time) }
+}
+
+// Serve agent requests on the Unix socket in the antipaste home directory
+// until an error occurs or ctx is done.
+func (agent *Agent) Serve(ctx context.Context) error {
+	sockFile, err := agentSocket()
+	if err != nil {
+		return err
+	}
+	// Remove a stale socket left behind by an agent that is no longer running
+	if conn, err := net.Dial("unix", sockFile); err == nil {
+		conn.Close()
+		return newError(ErrUsage, "Agent already running on %s", sockFile)
+	}
+	os.Remove(sockFile)
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	if err = os.Chmod(sockFile, 0600); err != nil {
+		return err
+	}
+	server := rpc.NewServer()
+	if err = server.Register(agent); err != nil {
+		return err
+	}
+	go func() {
+		for _ = range time.Tick(time.Second) {
+			agent.expire()
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "Agent listening on %s\n", sockFile)
+	if *jsonOutput {
+		if err = writeJson(&AgentResult{ Socket: sockFile }); err != nil {
+			return err
+		}
+	}
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// Lock keys whose time is up, by reloading them from their stored packets.
+func (agent *Agent) expire() {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	now := time.Now()
+	for fingerprint, expires := range agent.expires {
+		if now.Before(expires) {
+			continue
+		}
+		delete(agent.expires, fingerprint)
+		for i, entity := range agent.pgp.SecRing {
+			fp, _ := FpToString(entity.PrimaryKey.Fingerprint)
+			if fp != fingerprint {
+				continue
+			}
+			locked, err := openpgp.ReadKeyRing(
+				bytes.NewBuffer(agent.pgp.secPackets[fingerprint]))
+			if err != nil || len(locked) == 0 {
+				// Can't restore it, so drop it rather than keep it unlocked
+				agent.pgp.SecRing = append(agent.pgp.SecRing[:i], agent.pgp.SecRing[i+1:]...)
+			} else {
+				agent.pgp.SecRing[i] = locked[0]
+			}
+			break
+		}
+	}
+}
+
+// Decrypt a session key with the first unlocked secret key that can.
+func (agent *Agent) Decrypt(args *AgentDecryptArgs, reply *AgentDecryptReply) error {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	locked := make(map[string]bool)
+	for _, raw := range args.EncryptedKeys {
+		p, err := packet.Read(bytes.NewBuffer(raw))
+		if err != nil {
+			continue
+		}
+		ek, is := p.(*packet.EncryptedKey)
+		if !is {
+			continue
+		}
+		for _, key := range agent.pgp.SecRing.KeysById(ek.KeyId) {
+			if key.PrivateKey == nil {
+				continue
+			}
+			fingerprint, _ := FpToString(key.Entity.PrimaryKey.Fingerprint)
+			if key.PrivateKey.Encrypted {
+				if !locked[fingerprint] {
+					locked[fingerprint] = true
+					reply.Locked = append(reply.Locked, fingerprint)
+				}
+				continue
+			}
+			if err = ek.Decrypt(key.PrivateKey, nil); err == nil {
+				reply.CipherFunc = uint8(ek.CipherFunc)
+				reply.Key = ek.Key
+				reply.Locked = nil
+				return nil
+			}
+		}
+	}
+	if len(reply.Locked) == 0 {
+		return pgperrors.ErrKeyIncorrect
+	}
+	return nil
+}
+
+// Unlock a secret key until the agent's TTL runs out.
+func (agent *Agent) Unlock(args *AgentUnlockArgs, reply *bool) error {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	for _, entity := range agent.pgp.SecRing {
+		fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		if fingerprint != args.Fingerprint {
+			continue
+		}
+		*reply = unlockWith(entity, args.Passphrase) == nil
+		if *reply {
+			agent.expires[fingerprint] = time.Now().Add(agent.ttl)
+		}
+		return nil
+	}
+	return newError(ErrNotFound, "Secret key not found: %s", args.Fingerprint)
+}
+
+// Connect to a running agent.
+func dialAgent() (*rpc.Client, error) {
+	sockFile, err := agentSocket()
+	if err != nil {
+		return nil, err
+	}
+	return rpc.Dial("unix", sockFile)
+}
+
+// Decrypt a message, having the agent recover the session key. Anything
+// other than a message encrypted to public keys is handed to ReadMessage,
+// as is a message the agent holds no key for, such as one encrypted to a
+// key created after the agent started.
+func (pgp *Pgp) decryptWithAgent(client *rpc.Client, r io.Reader) (*openpgp.MessageDetails, error) {
+	// Everything read is recorded until the encrypted data, so that it
+	// can be replayed to ReadMessage
+	rr := &recordingReader{ r: r }
+	replay := func() (*openpgp.MessageDetails, error) {
+		rr.stopped = true
+		return openpgp.ReadMessage(io.MultiReader(bytes.NewBuffer(rr.buf.Bytes()), rr),
+			pgp.keyRing(), pgp.prompt, nil)
+	}
+	var keyIds []uint64
+	var encryptedKeys [][]byte
+	var se *packet.SymmetricallyEncrypted
+	for se == nil {
+		start := rr.buf.Len()
+		p, err := packet.Read(rr)
+		if err != nil {
+			if _, is := err.(pgperrors.UnsupportedError); is {
+				continue
+			}
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			keyIds = append(keyIds, p.KeyId)
+			encryptedKeys = append(encryptedKeys, append([]byte{}, rr.buf.Bytes()[start:]...))
+		case *packet.SymmetricallyEncrypted:
+			se = p
+		default:
+			return replay()
+		}
+	}
+	reply, err := pgp.agentDecrypt(client, encryptedKeys)
+	if agentKeyIncorrect(err) {
+		return replay()
+	} else if err != nil {
+		return nil, err
+	}
+	rr.stopped = true
+	decrypted, err := se.Decrypt(packet.CipherFunction(reply.CipherFunc), reply.Key)
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(decrypted, pgp.keyRing(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	md.IsEncrypted = true
+	md.EncryptedToKeyIds = keyIds
+	md.UnverifiedBody = &integrityCheckReader{ md: md, body: md.UnverifiedBody, decrypted: decrypted }
+	return md, nil
+}
+
+// Whether the agent answered that it holds none of the keys a message is
+// encrypted to. Errors come back from the agent as text.
+func agentKeyIncorrect(err error) bool {
+	serverErr, is := err.(rpc.ServerError)
+	return is && string(serverErr) == pgperrors.ErrKeyIncorrect.Error()
+}
+
+// Ask the agent for a session key, unlocking keys in the agent with
+// passphrases prompted for here until one works.
+func (pgp *Pgp) agentDecrypt(client *rpc.Client, encryptedKeys [][]byte) (*AgentDecryptReply, error) {
+	attempts := 0
+	for {
+		reply := &AgentDecryptReply{}
+		err := client.Call("Agent.Decrypt", &AgentDecryptArgs{ EncryptedKeys: encryptedKeys }, reply)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Key != nil {
+			return reply, nil
+		}
+		if attempts >= passphraseAttempts {
+			return nil, ErrBadPassphrase
+		}
+		fingerprint := reply.Locked[0]
+		prompt := fmt.Sprintf("Passphrase for %s", fingerprint)
+		for _, entity := range pgp.SecRing {
+			fp, _ := FpToString(entity.PrimaryKey.Fingerprint)
+			if fp == fingerprint {
+				prompt = keyPrompt(entity)
+			}
+		}
+		passphrase, err := readPassphrase(prompt)
+		if err != nil {
+			return nil, err
+		}
+		var unlocked bool
+		err = client.Call("Agent.Unlock",
+			&AgentUnlockArgs{ Fingerprint: fingerprint, Passphrase: passphrase }, &unlocked)
+		if err != nil {
+			return nil, err
+		}
+		if !unlocked {
+			if !interactivePassphrase() {
+				return nil, ErrBadPassphrase
+			}
+			fmt.Fprintf(os.Stderr, "Bad passphrase, try again\n")
+		}
+		attempts++
+	}
+}
+
+// Checks the modification detection code of a message decrypted outside
+// of ReadMessage once its body has been read, reporting a failure the
+// same way ReadMessage does.
+type integrityCheckReader struct {
+	md *openpgp.MessageDetails
+	body io.Reader
+	decrypted io.ReadCloser
+}
+
+func (icr *integrityCheckReader) Read(p []byte) (int, error) {
+	n, err := icr.body.Read(p)
+	if err == io.EOF {
+		if mdcErr := icr.decrypted.Close(); mdcErr != nil {
+			icr.md.SignatureError = mdcErr
+			err = mdcErr
+		}
+	}
+	return n, err
+}
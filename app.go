@@ -1,12 +1,20 @@
 package antipaste
 
 import (
-	"errors"
-	"flag"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 	"github.com/cmars/go.crypto/openpgp"
 	"github.com/cmars/go.crypto/openpgp/armor"
 )
@@ -17,224 +25,1023 @@ const (
 	PutAction
 )
 
-var getUri = flag.String("get", "", "Get paste")
-var putProtocol = flag.String("put", "", "Put paste")
-var newKey = flag.Bool("new", false, "New key")
-var findKey = flag.String("find", "", "Find key")
-var keyserver = flag.String("hkp", "", "Keyserver")
-var importKey = flag.String("import", "", "Import key fingerprint")
-var usageError = errors.New("Usage: antipaste -get uri | -put <dest> <file> [id1[,id2,...]] | ...")
+var signerId = putFlags.String("signer", "", "Signing key fingerprint or user ID (default: first secret key)")
+var noSelf = putFlags.Bool("no-self", false, "Do not also encrypt pastes to your own keys")
+var symmetric = putFlags.Bool("symmetric", false, "Encrypt paste with a passphrase instead of keys")
+var linkKey = putFlags.Bool("link", false, "Encrypt paste with a random key carried in the returned URI")
+var expire = putFlags.Duration("expire", 0, "Have pastes expire after this long, such as 1h")
+var extractDir = getFlags.String("extract", "", "Extract paste into directory instead of writing it to stdout")
+var findKeyserver = keyFindFlags.String("hkp", "", "Keyserver")
+var importKeyserver = keyImportFlags.String("hkp", "", "Keyserver")
+var importFile = keyImportFlags.String("file", "", "Import keys from file instead of a keyserver")
+var listSecretKeys = keyListFlags.Bool("secret", false, "List secret keys")
+var deleteSecretKey = keyDeleteFlags.Bool("secret", false, "Delete the secret key along with the public key")
+var untrust = keyTrustFlags.Bool("remove", false, "Stop trusting the key")
+var historyPrune = historyFlags.Bool("prune", false, "Remove expired pastes from the history")
+var pruneRemote = historyFlags.Bool("remote", false, "With -prune, also delete expired pastes where they were posted")
 
 type App struct {
 	pgp *Pgp
+	config *Config
+	// Cancelled on interrupt, abandoning network requests
+	ctx context.Context
+	progress *Progress
 	Action int
 	Protocol string
 	Handler ProtocolHandler
 	// getAction arguments
 	getTarget string
+	getLinkKey []byte
 	// putAction arguments
-	putFileName string
+	putFileNames []string
 	putRecipients []*openpgp.Entity
+	putSigner *openpgp.Entity
+	putPassphrase []byte
+	putLinkKey []byte
+	// Expiry applied to the paste, which may differ from -expire
+	putExpiry time.Duration
 }
 
 func NewApp() *App {
 	app := &App{}
 	app.pgp = &Pgp{}
-	app.pgp.Load()
+	app.ctx = context.Background()
+	app.progress = NewProgress(os.Stderr, false)
 	return app
 }
 
-func (app *App) Run() error {
-	// Parse general command line flags
-	flag.Parse()
-	args := flag.Args()
-	if *getUri != "" {
-		if protocol, uri, err := parseUri(*getUri); err == nil {
-			// Ok, we found a uri.
-			app.Protocol = protocol
-			app.Handler = protocolHandlers[protocol]
-			app.getTarget = uri
-			return app.runGet()
-		} else {
+// Load the config file and key rings, which depend on -homedir and
+// -config, and cancel the context on interrupt until the returned
+// function is called.
+func (app *App) setup() (context.CancelFunc, error) {
+	var err error
+	if app.config, err = LoadConfig(); err != nil {
+		return nil, err
+	}
+	if app.pgp.Keyservers, err = app.config.keyservers(); err != nil {
+		return nil, err
+	}
+	if err = app.pgp.Load(); err != nil {
+		return nil, err
+	}
+	app.progress = NewProgress(os.Stderr, *showProgress)
+	var cancel context.CancelFunc
+	app.ctx, cancel = context.WithCancel(app.ctx)
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		if _, ok := <-interrupts; ok {
+			// Let a second interrupt kill the process, should the
+			// command not stop
+			signal.Stop(interrupts)
+			cancel()
+		}
+	}()
+	return func() {
+		signal.Stop(interrupts)
+		cancel()
+	}, nil
+}
+
+func (app *App) cmdGet(args []string) error {
+	getUri, getLinkKey := splitLinkKey(args[0])
+	protocol, uri, err := parseUri(getUri)
+	if err != nil {
+		return err
+	}
+	// Ok, we found a uri.
+	app.Protocol = protocol
+	if app.Handler, err = NewHandler(protocol, app.config); err != nil {
+		return err
+	}
+	app.getTarget = uri
+	app.getLinkKey = getLinkKey
+	return app.runGet()
+}
+
+func (app *App) cmdPut(args []string) error {
+	// Assume its a paste, we'll check it...
+	var err error
+	app.Protocol = args[0]
+	if app.Protocol == "default" {
+		if app.config.Put == "" {
+			return newError(ErrUsage, "No default protocol set in config file")
+		}
+		app.Protocol = app.config.Put
+	}
+	if strings.Contains(app.Protocol, ",") {
+		app.Handler, err = NewMultiHandler(strings.Split(app.Protocol, ","), app.config)
+	} else {
+		app.Handler, err = NewHandler(app.Protocol, app.config)
+	}
+	if err != nil {
+		return err
+	}
+	if *expire > 0 {
+		if app.putExpiry, err = setExpiry(app.Handler, *expire); err != nil {
 			return err
 		}
-	} else if *putProtocol != "" {
-		// Assume its a paste, we'll check it...
-		app.Protocol = *putProtocol
-		var has bool
-		if app.Handler, has = protocolHandlers[app.Protocol]; !has {
-			return errors.New(fmt.Sprintf("Unknown protocol handler: %s",
-					app.Protocol))
-		}
-		// Parse the rest of the paste command line:
-		// <file> <recipients...>
-		var err error
-		var putRecipients []string
-		app.putFileName, putRecipients, err = parsePut(args)
-		if err != nil {
+	} else {
+		app.putExpiry = handlerExpiry(app.Handler)
+	}
+	// Parse the rest of the paste command line:
+	// <file...> [--] <recipients...>
+	var putRecipients []string
+	app.putFileNames, putRecipients, err = app.parsePut(args[1:], !*symmetric && !*linkKey)
+	if err != nil {
+		return err
+	}
+	if _, _, err = compression(); err != nil {
+		return err
+	}
+	if *symmetric && *linkKey {
+		return newError(ErrUsage, "Use only one of -symmetric and -link")
+	} else if *linkKey {
+		if app.putLinkKey, err = newLinkKey(); err != nil {
 			return err
 		}
-		if err = app.resolveRecipients(putRecipients); err == nil {
-			return app.runPut()
-		} else {
+		app.putPassphrase = app.putLinkKey
+		return app.runPut()
+	} else if *symmetric {
+		if app.putPassphrase, err = pastePassphrase(); err != nil {
 			return err
 		}
-	} else if *newKey {
-		if len(args) == 3 {
-			return app.runNewKey(args[0], args[1], args[2])
-		} else {
-			return errors.New("Usage: -new <name> <email> <comment>")
+		return app.runPut()
+	}
+	if err = app.resolveRecipients(putRecipients, !*noSelf && app.config.encryptToSelf()); err != nil {
+		return err
+	}
+	if err = app.resolveSigner(*signerId); err != nil {
+		return err
+	}
+	return app.runPut()
+}
+
+func (app *App) cmdDelete(args []string) error {
+	uri, _ := splitLinkKey(args[0])
+	// The chunks of a chunked paste are only known from the history
+	entry, err := findHistory(uri)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		for _, chunk := range entry.Chunks {
+			if err = deletePaste(app.ctx, chunk, app.config); err != nil && ErrorKind(err) != ErrNotFound {
+				return err
+			}
 		}
-	} else if *findKey != "" {
-		return app.runFindKey(*findKey, *keyserver)
-	} else if *importKey != "" {
-		return app.runImportKey(*importKey, *keyserver)
 	}
-	return usageError
+	if err = deletePaste(app.ctx, uri, app.config); err != nil {
+		return err
+	}
+	if err = forgetHistory(uri); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson(&DeleteResult{ Deleted: uri })
+	}
+	return nil
+}
+
+func (app *App) cmdKeyNew(args []string) error {
+	return app.runNewKey(args[0], args[1], args[2])
+}
+
+func (app *App) cmdKeyFind(args []string) error {
+	return app.runFindKey(args[0], *findKeyserver)
+}
+
+func (app *App) cmdKeyImport(args []string) error {
+	if *importFile != "" && len(args) == 0 {
+		return app.runImportFile(*importFile)
+	} else if *importFile == "" && len(args) == 1 {
+		return app.runImportKey(args[0], *importKeyserver)
+	}
+	return newError(ErrUsage, "Give either a fingerprint or -file <path>")
+}
+
+func (app *App) cmdKeyList(args []string) error {
+	if *listSecretKeys {
+		return app.runListKeys(app.pgp.SecRing, true)
+	}
+	return app.runListKeys(app.pgp.PubRing, false)
+}
+
+func (app *App) cmdKeyExport(args []string) error {
+	return app.runExport(args[0])
+}
+
+func (app *App) cmdKeyDelete(args []string) error {
+	return app.runDelete(args[0], *deleteSecretKey)
+}
+
+func (app *App) cmdKeyTrust(args []string) error {
+	return app.runTrust(args[0], !*untrust)
+}
+
+func (app *App) cmdKeyPasswd(args []string) error {
+	return app.runPasswd(args[0])
+}
+
+func (app *App) cmdHistory(args []string) error {
+	if *historyPrune {
+		if len(args) > 0 {
+			return newError(ErrUsage, "Search terms can't be given with -prune")
+		}
+		return app.runHistoryPrune(*pruneRemote)
+	} else if *pruneRemote {
+		return newError(ErrUsage, "-remote is only used with -prune")
+	}
+	return app.runHistory(args)
+}
+
+func (app *App) cmdAgent(args []string) error {
+	return NewAgent(app.pgp, *agentTtl).Serve(app.ctx)
+}
+
+func (app *App) cmdHelp(args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return nil
+	}
+	cmd, rest := findCommand(args)
+	if cmd == nil || len(rest) > 0 {
+		return newError(ErrUsage, "Unknown command: %s\n%s", strings.Join(args, " "), usage())
+	}
+	cmd.printHelp(os.Stdout)
+	return nil
 }
 
 func (app *App) runGet() (err error) {
-	r, err := app.Handler.ReadPaste(app.getTarget)
+	defer app.progress.Done()
+	var md *openpgp.MessageDetails
+	var r io.Closer
+	if multi, ok := app.Handler.(*MultiHandler); ok {
+		md, r, err = app.openMulti(multi, app.getTarget)
+	} else {
+		md, r, err = app.openPaste(app.Handler, app.getTarget)
+	}
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	block, err := armor.Decode(r)
+	md.UnverifiedBody = io.TeeReader(md.UnverifiedBody, app.progress.stage("decrypted"))
+	if *extractDir != "" {
+		extracted, err := app.extract(md, *extractDir)
+		if err != nil {
+			return err
+		}
+		if *jsonOutput {
+			return writeJson(app.pgp.getResult(md, extracted, nil))
+		}
+		return nil
+	}
+	if md.LiteralData != nil && md.LiteralData.FileName == archiveFileName {
+		fmt.Fprintf(os.Stderr, "Paste is a tar archive, use get -extract <dir> to unpack it\n")
+	}
+	// The signature can only be checked once the body is fully drained.
+	// With -json the content is held back until then, as part of the result.
+	if *jsonOutput {
+		content, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			return err
+		}
+		app.progress.Done()
+		if err = app.pgp.verifySigner(md); err != nil {
+			return err
+		}
+		return writeJson(app.pgp.getResult(md, nil, content))
+	}
+	_, err = io.Copy(os.Stdout, md.UnverifiedBody)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ASCII-armor failed: %v\n", err)
 		return err
 	}
-	decOut, err := app.pgp.decrypt(block.Body)
+	app.progress.Done()
+	return app.pgp.verifySigner(md)
+}
+
+// Fetch and decrypt a paste. The returned closer must be closed once the
+// message body has been read.
+func (app *App) openPaste(handler ProtocolHandler, target string) (*openpgp.MessageDetails, io.Closer, error) {
+	r, err := handler.ReadPaste(app.ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := armor.Decode(io.TeeReader(r, app.progress.stage("downloaded")))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Decrypt failed: %v\n", err)
+		r.Close()
+		return nil, nil, newError(ErrNotFound, "No paste found at %s: %v", target, err)
+	}
+	var md *openpgp.MessageDetails
+	if app.getLinkKey != nil {
+		md, err = app.pgp.decryptWithPassphrase(block.Body, app.getLinkKey)
+	} else {
+		md, err = app.pgp.decrypt(block.Body)
+	}
+	if err != nil {
+		r.Close()
+		return nil, nil, decryptError(err)
+	}
+	if md.LiteralData != nil && md.LiteralData.FileName == manifestFileName {
+		if md, err = app.readChunked(md); err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+	}
+	return md, r, nil
+}
+
+// Open the first copy of a paste posted to several destinations that can
+// be fetched and decrypted. A wrong passphrase is not worth trying again.
+func (app *App) openMulti(multi *MultiHandler, target string) (*openpgp.MessageDetails, io.Closer, error) {
+	var lastErr error = ErrNotFound
+	for _, uri := range multi.Members(target) {
+		protocol, memberTarget, err := parseUri(uri)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", uri, err)
+			continue
+		}
+		handler, err := NewHandler(protocol, app.config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", uri, err)
+			continue
+		}
+		md, r, err := app.openPaste(handler, memberTarget)
+		if err == nil {
+			return md, r, nil
+		} else if ErrorKind(err) == ErrBadPassphrase {
+			return nil, nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Reading %s failed: %v\n", uri, err)
+		lastErr = err
+	}
+	kind := ErrorKind(lastErr)
+	if kind == nil {
+		kind = ErrNotFound
+	}
+	return nil, nil, newError(kind, "No copy of the paste could be read")
+}
+
+// Reassemble and decrypt a paste split into chunks, given its manifest.
+// The chunks are encrypted the same way as the manifest.
+func (app *App) readChunked(manifestMd *openpgp.MessageDetails) (*openpgp.MessageDetails, error) {
+	data, err := ioutil.ReadAll(manifestMd.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	app.progress.Done()
+	if err = app.pgp.verifySigner(manifestMd); err != nil {
+		return nil, err
+	}
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := readChunks(app.ctx, manifest, app.config, app.progress.stage("downloaded"))
+	if err != nil {
+		return nil, err
+	}
+	var md *openpgp.MessageDetails
+	if app.getLinkKey != nil {
+		md, err = app.pgp.decryptWithPassphrase(ciphertext, app.getLinkKey)
+	} else if manifestMd.IsSymmetricallyEncrypted && app.pgp.symmetricPassphrase != nil {
+		md, err = app.pgp.decryptWithPassphrase(ciphertext, app.pgp.symmetricPassphrase)
+	} else {
+		md, err = app.pgp.decrypt(ciphertext)
+	}
+	if err != nil {
+		return nil, decryptError(err)
+	}
+	if md.LiteralData != nil && md.LiteralData.FileName == manifestFileName {
+		return nil, newError(ErrDecryptFailed, "Chunks hold another manifest")
+	}
+	return md, nil
+}
+
+// Describe a failure to decrypt a paste. Bad passphrases and interrupts
+// are left as they are.
+func decryptError(err error) error {
+	if kind := ErrorKind(err); kind == ErrBadPassphrase || kind == ErrInterrupted {
 		return err
 	}
-	_, err = io.Copy(os.Stdout, decOut)
-	return err
+	return newError(ErrDecryptFailed, "Decrypt failed: %v", err)
+}
+
+// Unpack a paste into a directory: an archive is extracted, a single file
+// is written under its own name. Nothing is written until the signature
+// has been checked. Returns the paths written.
+func (app *App) extract(md *openpgp.MessageDetails, dir string) ([]string, error) {
+	tmpF, err := ioutil.TempFile("", "antipaste")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpF.Name())
+	defer tmpF.Close()
+	if _, err = io.Copy(tmpF, md.UnverifiedBody); err != nil {
+		return nil, err
+	}
+	app.progress.Done()
+	if err = app.pgp.verifySigner(md); err != nil {
+		return nil, err
+	}
+	if _, err = tmpF.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	fileName := ""
+	if md.LiteralData != nil {
+		fileName = md.LiteralData.FileName
+	}
+	if fileName == archiveFileName {
+		return extractArchive(dir, tmpF)
+	}
+	fileName = filepath.Base(filepath.FromSlash(fileName))
+	if fileName == "." || fileName == ".." || fileName == string(filepath.Separator) ||
+			fileName == "" || fileName == "_CONSOLE" {
+		fileName = "paste"
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	target := filepath.Join(dir, fileName)
+	if err = extractFile(target, 0600, tmpF); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", target)
+	return []string{ target }, nil
+}
+
+// Report who signed a fully read message, and whether we trust them. Fail
+// if the signature is bad or the signer is unknown, warn if the message
+// was not signed at all.
+func (pgp *Pgp) verifySigner(md *openpgp.MessageDetails) error {
+	if !md.IsSigned {
+		fmt.Fprintf(os.Stderr, "Warning: paste is not signed\n")
+		return nil
+	}
+	if md.SignedBy == nil {
+		fmt.Fprintf(os.Stderr, "Signed by unknown key ID %016X\n", md.SignedByKeyId)
+		return ErrUnknownSigner
+	}
+	if md.SignatureError != nil {
+		fmt.Fprintf(os.Stderr, "Bad signature: %v\n", md.SignatureError)
+		return ErrBadSignature
+	}
+	fingerprint, _ := FpToString(md.SignedBy.Entity.PrimaryKey.Fingerprint)
+	trust := ""
+	if !pgp.isTrusted(md.SignedBy.Entity) {
+		trust = " (key not trusted)"
+	}
+	fmt.Fprintf(os.Stderr, "Good signature from %s %s%s\n",
+		fingerprint, primaryUid(md.SignedBy.Entity), trust)
+	return nil
 }
 
 func (app *App) runPut() (err error) {
+	defer app.progress.Done()
 	// Create a pipe between the encryption and the protocol handler
 	pipeReader, pipeWriter := io.Pipe()
-	// Open the plaintext input we're encrypting
+	// Open the plaintext input we're encrypting. Several files, or a
+	// directory, are packed into an archive as they are encrypted.
 	var srcIn io.Reader
-	if app.putFileName == "-" {
+	hints := &openpgp.FileHints{ IsBinary: true }
+	archive := needsArchive(app.putFileNames)
+	if archive {
+		hints.FileName = archiveFileName
+	} else if app.putFileNames[0] == "-" {
 		srcIn = os.Stdin
 	} else {
-		srcF, err := os.Open(app.putFileName)
+		srcF, err := os.Open(app.putFileNames[0])
 		if err != nil {
 			return err
 		}
 		defer srcF.Close()
 		srcIn = srcF
+		hints.FileName = filepath.Base(app.putFileNames[0])
+		if info, err := srcF.Stat(); err == nil {
+			hints.ModTime = info.ModTime()
+		}
+	}
+	encrypted := app.progress.stage("encrypted")
+	writePlain := func(plainOut io.Writer) error {
+		plainOut = io.MultiWriter(plainOut, encrypted)
+		if archive {
+			return writeArchive(plainOut, app.putFileNames)
+		}
+		_, err := io.Copy(plainOut, srcIn)
+		return err
 	}
-	// Start writing to the pipe
+	// Start writing to the pipe. Chunks are armored one by one, so chunked
+	// pastes go through the pipe as binary.
+	cipherOut := &countingWriter{ w: pipeWriter }
 	go func(){
-		encOut, err := armor.Encode(pipeWriter, "ANTIPASTE", nil)
-		if err != nil {
-			fmt.Printf("ASCII-armor failed: %v\n", err)
+		if *chunkSize > 0 {
+			pipeWriter.CloseWithError(app.encryptPaste(cipherOut, hints, writePlain))
 			return
 		}
-		plainOut, err := app.pgp.encrypt(encOut, app.putRecipients)
+		encOut, err := armor.Encode(cipherOut, "ANTIPASTE", nil)
 		if err != nil {
-			fmt.Printf("Encrypt failed: %v\n", err)
+			fmt.Fprintf(os.Stderr, "ASCII-armor failed: %v\n", err)
+			pipeWriter.CloseWithError(err)
+			return
+		}
+		if err = app.encryptPaste(encOut, hints, writePlain); err != nil {
+			pipeWriter.CloseWithError(err)
 			return
 		}
-		_, err = io.Copy(plainOut, srcIn)
-		err = plainOut.Close()
 		encOut.Close()
 		pipeWriter.Close()
 	}()
-	// Protocol handler reads the encrypted content from the pipe
-	pasteUrl, err := app.Handler.WritePaste(pipeReader)
+	// Protocol handler reads the encrypted content from the pipe, as it
+	// is written if the handler streams
+	upload := io.TeeReader(pipeReader, app.progress.stage("uploaded"))
+	var pasteUrl string
+	var chunkUris []string
+	if *chunkSize > 0 {
+		pasteUrl, chunkUris, err = app.writeChunked(upload)
+	} else {
+		pasteUrl, err = app.Handler.WritePaste(app.ctx, upload)
+	}
 	if err != nil {
+		// Stop the encryption blocked on the pipe
+		pipeReader.CloseWithError(err)
 		return err
 	}
+	app.progress.Done()
+	// The link key is left out of the history
+	entry := app.historyEntry(pasteUrl, cipherOut.n)
+	entry.Chunks = chunkUris
+	if app.putLinkKey != nil {
+		pasteUrl = fmt.Sprintf("%s%s%s", pasteUrl, linkKeyFragment, app.putLinkKey)
+	}
+	if err = recordHistory(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: paste not recorded in history: %v\n", err)
+	}
+	if *jsonOutput {
+		// The result is the history entry, with the link key
+		result := *entry
+		result.Uri = pasteUrl
+		return writeJson(&result)
+	}
 	fmt.Fprintf(os.Stdout, "%v\n", pasteUrl)
+	if entry.Expires != nil {
+		fmt.Fprintf(os.Stderr, "Expires: %s\n", entry.Expires.Format(time.RFC1123))
+	}
 	return nil
 }
 
-func (app *App) resolveRecipients(putRecipients []string) error {
-	recipients := make(map[string]*openpgp.Entity)
+// Encrypt a paste to the recipients or passphrase given, with the
+// plaintext written by writePlain.
+func (app *App) encryptPaste(w io.Writer, hints *openpgp.FileHints, writePlain func(io.Writer) error) error {
+	var plainOut io.WriteCloser
+	var err error
+	if app.putPassphrase != nil {
+		plainOut, err = app.pgp.encryptSymmetric(w, app.putPassphrase, hints)
+	} else {
+		plainOut, err = app.pgp.encrypt(w, app.putRecipients, app.putSigner, hints)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Encrypt failed: %v\n", err)
+		return err
+	}
+	if err = writePlain(plainOut); err != nil {
+		fmt.Fprintf(os.Stderr, "Reading input failed: %v\n", err)
+		return err
+	}
+	return plainOut.Close()
+}
+
+// Post ciphertext in chunks of -chunk-size bytes, followed by a manifest
+// listing them, encrypted like the paste itself. Returns the manifest URI
+// and the chunk URIs.
+func (app *App) writeChunked(ciphertext io.Reader) (string, []string, error) {
+	manifest, err := writeChunks(app.ctx, app.Handler, ciphertext, *chunkSize, app.progress)
+	if err != nil {
+		return "", nil, err
+	}
+	chunkUris := []string{}
+	for _, chunk := range manifest.Chunks {
+		chunkUris = append(chunkUris, chunk.Uri)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", nil, err
+	}
+	armored := bytes.NewBuffer(nil)
+	encOut, err := armor.Encode(armored, "ANTIPASTE", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	hints := &openpgp.FileHints{ IsBinary: true, FileName: manifestFileName }
+	err = app.encryptPaste(encOut, hints, func(plainOut io.Writer) error {
+		_, err := plainOut.Write(data)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	encOut.Close()
+	pasteUrl, err := app.Handler.WritePaste(app.ctx, armored)
+	return pasteUrl, chunkUris, err
+}
+
+func (app *App) historyEntry(pasteUrl string, size int64) *HistoryEntry {
+	now := time.Now()
+	entry := &HistoryEntry{
+		Uri: pasteUrl,
+		Protocol: app.Protocol,
+		Link: app.putLinkKey != nil,
+		Files: []string{},
+		Size: size,
+		Created: now }
+	if app.putExpiry > 0 {
+		expires := now.Add(app.putExpiry)
+		entry.Expires = &expires
+	}
+	if app.putPassphrase == nil {
+		for _, recipient := range app.putRecipients {
+			fingerprint, _ := FpToString(recipient.PrimaryKey.Fingerprint)
+			entry.Recipients = append(entry.Recipients, fingerprint)
+		}
+	}
+	for _, fileName := range app.putFileNames {
+		if absName, err := filepath.Abs(fileName); err == nil && fileName != "-" {
+			fileName = absName
+		}
+		entry.Files = append(entry.Files, fileName)
+	}
+	return entry
+}
+
+// List the pastes made, newest first, that match all the search terms.
+func (app *App) runHistory(terms []string) error {
+	entries, err := LoadHistory()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	matching := []*HistoryEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		matches := true
+		for _, term := range terms {
+			if !app.pgp.historyMatches(entries[i], term) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			matching = append(matching, entries[i])
+		}
+	}
+	if *jsonOutput {
+		return writeJson(matching)
+	}
+	for _, entry := range matching {
+		app.pgp.listHistoryEntry(os.Stdout, entry, now)
+	}
+	return nil
+}
+
+// Remove expired pastes from the history, deleting them remotely first
+// if asked. Pastes which fail to be deleted are kept; those already gone,
+// or which their paste service expires on its own, are not.
+func (app *App) runHistoryPrune(remote bool) error {
+	entries, err := LoadHistory()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	kept := []*HistoryEntry{}
+	result := &PruneResult{ Pruned: []string{} }
+	var lastErr error
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			kept = append(kept, entry)
+			continue
+		}
+		if remote {
+			if err = app.deleteEntry(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "Deleting %s failed: %v\n", entry.Uri, err)
+				kept = append(kept, entry)
+				result.Failed = append(result.Failed, entry.Uri)
+				lastErr = err
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Pruned %s\n", entry.Uri)
+		result.Pruned = append(result.Pruned, entry.Uri)
+	}
+	if err = SaveHistory(kept); err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		kind := ErrorKind(lastErr)
+		if kind == nil {
+			kind = ErrRejected
+		}
+		err = newError(kind, "%d expired pastes were not deleted", len(result.Failed))
+		if !*jsonOutput {
+			return err
+		}
+		result.Error = errorResult(err)
+		if jsonErr := writeJson(result); jsonErr != nil {
+			return jsonErr
+		}
+		return &reportedError{ err: err }
+	}
+	if *jsonOutput {
+		return writeJson(result)
+	}
+	return nil
+}
+
+// Delete an expired paste where it was posted, chunks first.
+func (app *App) deleteEntry(entry *HistoryEntry) error {
+	for _, uri := range append(append([]string{}, entry.Chunks...), entry.Uri) {
+		if err := deleteExpired(app.ctx, uri, app.config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether an argument names a recipient group or matches a public key,
+// as resolveRecipients would take it.
+func (app *App) isRecipient(arg string) bool {
+	if strings.HasPrefix(arg, "@") {
+		_, has := app.config.Groups[arg[1:]]
+		return has
+	}
+	return app.pgp.matchesRecipient(arg)
+}
+
+// Resolve recipients given on the command line. An argument of the form
+// @name expands to the members of the group of that name in the config
+// file; a group with a single member serves as an alias. With toSelf, the
+// author's own keys are added so they can read the paste later.
+func (app *App) resolveRecipients(putRecipients []string, toSelf bool) error {
+	ids := []string{}
 	for _, recipient := range putRecipients {
-		entity := app.pgp.resolveRecipient(recipient)
-		if entity == nil {
-			return errors.New(fmt.Sprintf("Recipient not found: %s", recipient))
+		if strings.HasPrefix(recipient, "@") {
+			members, has := app.config.Groups[recipient[1:]]
+			if !has {
+				return newError(ErrUnknownRecipient, "Recipient group not found: %s", recipient)
+			}
+			ids = append(ids, members...)
+		} else {
+			ids = append(ids, recipient)
+		}
+	}
+	recipients := make(map[string]*openpgp.Entity)
+	for _, id := range ids {
+		entity, err := app.pgp.resolveRecipient(id)
+		if err != nil {
+			return err
 		}
 		fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
 		recipients[fingerprint] = entity
 	}
+	if toSelf {
+		app.addSelfRecipients(recipients)
+	}
 	// Clean up recipient list, make unique just in case there were collisions
 	result := []*openpgp.Entity{}
-	for _, entity := range recipients {
+	problems := []string{}
+	now := time.Now()
+	for fingerprint, entity := range recipients {
+		problem, warning := checkRecipient(entity, now)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("  %s %s: %s",
+				fingerprint, primaryUid(entity), problem))
+		} else if warning != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s %s: %s\n",
+				fingerprint, primaryUid(entity), warning)
+		}
 		result = append(result, entity)
 	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return newError(ErrUnknownRecipient, "Cannot encrypt to:\n%s", strings.Join(problems, "\n"))
+	}
 	app.putRecipients = result
 	return nil
 }
 
-func parsePut(args []string) (fileName string, recipients []string, err error) {
+// Add the author's keys to the recipients: the key chosen with -signer,
+// or else every secret key. Keys that can't be encrypted to are skipped
+// with a warning rather than failing the paste.
+func (app *App) addSelfRecipients(recipients map[string]*openpgp.Entity) {
+	self := app.pgp.SecRing
+	if *signerId != "" {
+		self = openpgp.EntityList{}
+		if entity, err := app.pgp.resolveSigner(*signerId); err == nil {
+			self = append(self, entity)
+		}
+	}
+	now := time.Now()
+	for _, entity := range self {
+		fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		if _, has := recipients[fingerprint]; has {
+			continue
+		}
+		if problem, _ := checkRecipient(entity, now); problem != "" {
+			fmt.Fprintf(os.Stderr, "Warning: not encrypting to own key %s: %s\n",
+				fingerprint, problem)
+			continue
+		}
+		recipients[fingerprint] = entity
+	}
+}
+
+// Select the secret key used to sign the paste. Without an explicit id the
+// first secret key is used; with no secret keys at all the paste goes out
+// unsigned.
+func (app *App) resolveSigner(id string) error {
+	var err error
+	if app.putSigner, err = app.pgp.resolveSigner(id); err != nil {
+		return err
+	} else if app.putSigner == nil {
+		fmt.Fprintf(os.Stderr, "Warning: no secret key, paste will not be signed\n")
+		return nil
+	}
+	return app.pgp.unlock(app.putSigner)
+}
+
+// Parse the inputs and recipients of a paste. Inputs come first, and may
+// be separated from the recipients by --. Without --, the first argument
+// and any following ones naming existing files or directories are inputs,
+// the rest are recipients; an argument that is both a path and a known
+// recipient is refused as ambiguous. Recipients are only required when
+// encrypting to keys, otherwise every argument is an input.
+func (app *App) parsePut(args []string, needRecipients bool) (fileNames []string, recipients []string, err error) {
+	fileNames = []string{}
 	recipients = []string{}
+	separator := -1
 	for i, arg := range(args) {
-		switch i {
-		case 0:
-			fileName = arg
-		default:
-			recipients = append(recipients, arg)
-		}
-	}
-	switch {
-	case fileName == "" || len(recipients) == 0:
-		err = errors.New("Too few arguments")
-	case fileName == "-":
-		;
-	default:
+		if arg == "--" {
+			separator = i
+			break
+		}
+	}
+	if separator >= 0 {
+		fileNames = append(fileNames, args[:separator]...)
+		recipients = append(recipients, args[separator+1:]...)
+		if !needRecipients && len(recipients) > 0 {
+			return nil, nil, newError(ErrUsage, "Recipients can't be given with -symmetric or -link")
+		}
+	} else {
+		for i, arg := range(args) {
+			_, statErr := os.Stat(arg)
+			if len(recipients) == 0 && (i == 0 || statErr == nil || !needRecipients) {
+				if i > 0 && needRecipients && app.isRecipient(arg) {
+					return nil, nil, newError(ErrUsage,
+						"%s is both a file and a recipient, put -- between files and recipients", arg)
+				}
+				fileNames = append(fileNames, arg)
+			} else {
+				recipients = append(recipients, arg)
+			}
+		}
+	}
+	if len(fileNames) == 0 || (needRecipients && len(recipients) == 0) {
+		return nil, nil, newError(ErrUsage, "Too few arguments")
+	}
+	for _, fileName := range fileNames {
+		if fileName == "-" {
+			if len(fileNames) > 1 {
+				return nil, nil, newError(ErrUsage, "Standard input must be pasted on its own")
+			}
+			continue
+		}
 		info, statErr := os.Stat(fileName)
 		if statErr != nil {
-			err = statErr
-		} else if info.IsDir() {
-			err = errors.New(fmt.Sprintf("Not a valid input file: %s", fileName))
+			return nil, nil, statErr
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil, nil, newError(ErrUsage, "Not a valid input file: %s", fileName)
 		}
 	}
 	return
 }
 
+// URI fragment that carries the key of a -link paste.
+const linkKeyFragment = "#k="
+
+// Generate a random key for a -link paste, as URI-safe text.
+func newLinkKey() ([]byte, error) {
+	random := make([]byte, 18)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return nil, err
+	}
+	return []byte(base64.URLEncoding.EncodeToString(random)), nil
+}
+
+// Split the key of a -link paste off a URI, if it has one.
+func splitLinkKey(uri string) (string, []byte) {
+	if i := strings.LastIndex(uri, linkKeyFragment); i >= 0 {
+		return uri[:i], []byte(uri[i+len(linkKeyFragment):])
+	}
+	return uri, nil
+}
+
 // Parse a URI into protocol, parameter URI to that plugin used to fetch content.
 // Return an error if it's not a valid antipaste URI.
 func parseUri(uri string) (string, string, error) {
 	parts := strings.SplitN(uri, ":", 2)
 	if len(parts) > 1 {
-		if parts[0] == "http" {
-			return "http", uri, nil
-		} else if _, has := protocolHandlers[parts[0]]; has {
+		if parts[0] == "http" || parts[0] == "https" {
+			return parts[0], uri, nil
+		} else if HasHandler(parts[0]) {
 			return parts[0], parts[1], nil
 		}
 	} else if info, err := os.Stat(uri); err == nil && !info.IsDir() {
 		return "file", uri, nil
 	}
-	return "", "", errors.New(fmt.Sprintf("Not an antipaste URI: %s", uri))
+	return "", "", newError(ErrUsage, "Not an antipaste URI: %s", uri)
 }
 
 func (app *App) runNewKey(name string, email string, comment string) error {
-	_, err := app.pgp.GenKey(name, email, comment)
+	passphrase, err := readNewPassphrase("Passphrase for new key (empty for none)")
 	if err != nil {
 		return err
 	}
-	return app.pgp.Save()
+	entity, err := app.pgp.GenKey(name, email, comment, passphrase)
+	if err != nil {
+		return err
+	}
+	if err = app.pgp.Save(); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson(entityKeyResult(entity, true))
+	}
+	return nil
 }
 
-func (app *App) runFindKey(findKey string, keyserver string) error {
-	if keyserver == "" {
-		keyserver = "pgp.mit.edu"
+func (app *App) runPasswd(keyid string) error {
+	entity, err := app.pgp.resolveSigner(keyid)
+	if err != nil {
+		return err
+	}
+	if err = app.pgp.unlock(entity); err != nil {
+		return err
+	}
+	passphrase, err := readNewPassphrase("New passphrase (empty for none)")
+	if err != nil {
+		return err
+	}
+	if err = app.pgp.SetPassphrase(entity, passphrase); err != nil {
+		return err
+	}
+	if err = app.pgp.Save(); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson(entityKeyResult(entity, true))
+	}
+	return nil
+}
+
+// Keyservers to try in order: the one given with -hkp, those in the
+// config file, or the default.
+func (app *App) keyservers(keyserver string) ([]*Hkp, error) {
+	if keyserver != "" {
+		hkp, err := ParseHkpUri(keyserver)
+		if err != nil {
+			return nil, err
+		}
+		return []*Hkp{ hkp }, nil
+	}
+	result := []*Hkp{}
+	for _, ks := range app.pgp.Keyservers {
+		result = append(result, NewHkp(ks.Hostname, ks.Port))
 	}
-	hkp, err := ParseHkpUri(keyserver)
+	if len(result) == 0 {
+		result = append(result, NewHkp(DefaultKeyserver, 0))
+	}
+	return result, nil
+}
+
+func (app *App) runFindKey(findKey string, keyserver string) error {
+	hkps, err := app.keyservers(keyserver)
 	if err != nil {
 		return err
 	}
-	results, err := hkp.Lookup(findKey)
+	var results []*HkpResult
+	for _, hkp := range hkps {
+		if results, err = hkp.Lookup(app.ctx, findKey); err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Lookup on %s failed: %v\n", hkp.Hostname, err)
+	}
 	if err != nil {
 		return err
 	}
+	if *jsonOutput {
+		keys := []*KeyResult{}
+		for _, result := range results {
+			keys = append(keys, hkpKeyResult(result))
+		}
+		return writeJson(keys)
+	}
 	for _, result := range results {
 		fmt.Fprintf(os.Stderr, "%v\n", *result)
 	}
@@ -242,18 +1049,127 @@ func (app *App) runFindKey(findKey string, keyserver string) error {
 }
 
 func (app *App) runImportKey(keyid string, keyserver string) error {
-	if keyserver == "" {
-		keyserver = "pgp.mit.edu"
-	}
-	hkp, err := ParseHkpUri(keyserver)
+	hkps, err := app.keyservers(keyserver)
 	if err != nil {
 		return err
 	}
-	result, err := hkp.Get(keyid)
+	var result *openpgp.Entity
+	for _, hkp := range hkps {
+		if result, err = hkp.Get(app.ctx, keyid); err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Get from %s failed: %v\n", hkp.Hostname, err)
+	}
 	if err != nil {
 		return err
 	}
 	app.pgp.PubRing = append(app.pgp.PubRing, result)
-	app.pgp.Save()
+	if err = app.pgp.Save(); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson([]*KeyResult{ entityKeyResult(result, false) })
+	}
+	return nil
+}
+
+func (app *App) runListKeys(keyring openpgp.EntityList, secret bool) error {
+	if *jsonOutput {
+		keys := []*KeyResult{}
+		for _, entity := range keyring {
+			key := entityKeyResult(entity, secret)
+			key.Trusted = app.pgp.isTrusted(entity)
+			keys = append(keys, key)
+		}
+		return writeJson(keys)
+	}
+	for _, entity := range keyring {
+		listEntity(os.Stdout, entity, secret, app.pgp.isTrusted(entity))
+	}
+	return nil
+}
+
+func (app *App) runExport(keyid string) error {
+	entity, err := app.pgp.resolveRecipient(keyid)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		armored := bytes.NewBuffer(nil)
+		if err = app.pgp.Export(armored, entity); err != nil {
+			return err
+		}
+		return writeJson(&ExportResult{ KeyResult: entityKeyResult(entity, false), Armored: armored.String() })
+	}
+	return app.pgp.Export(os.Stdout, entity)
+}
+
+func (app *App) runDelete(keyid string, secret bool) error {
+	entity, err := app.pgp.resolveRecipient(keyid)
+	if err != nil {
+		return err
+	}
+	if err = app.pgp.Delete(entity, secret); err != nil {
+		return err
+	}
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	fmt.Fprintf(os.Stderr, "Deleted %s %s\n", fingerprint, primaryUid(entity))
+	if err = app.pgp.Save(); err != nil {
+		return err
+	}
+	if err = app.pgp.saveTrust(); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson(&DeleteResult{ Deleted: fingerprint })
+	}
+	return nil
+}
+
+// Mark a public key as trusted, or no longer trusted.
+func (app *App) runTrust(keyid string, trusted bool) error {
+	entity, err := app.pgp.resolveRecipient(keyid)
+	if err != nil {
+		return err
+	}
+	app.pgp.SetTrust(entity, trusted)
+	if err = app.pgp.saveTrust(); err != nil {
+		return err
+	}
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	if trusted {
+		fmt.Fprintf(os.Stderr, "Trusted %s %s\n", fingerprint, primaryUid(entity))
+	} else {
+		fmt.Fprintf(os.Stderr, "No longer trusted %s %s\n", fingerprint, primaryUid(entity))
+	}
+	if *jsonOutput {
+		key := entityKeyResult(entity, false)
+		key.Trusted = app.pgp.isTrusted(entity)
+		return writeJson(key)
+	}
+	return nil
+}
+
+func (app *App) runImportFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entities, err := app.pgp.Import(data)
+	if err != nil {
+		return err
+	}
+	keys := []*KeyResult{}
+	for _, entity := range entities {
+		fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		fmt.Fprintf(os.Stderr, "Imported %s %s\n", fingerprint, primaryUid(entity))
+		keys = append(keys, entityKeyResult(entity, false))
+	}
+	if err = app.pgp.Save(); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return writeJson(keys)
+	}
 	return nil
 }
@@ -0,0 +1,140 @@
+package antipaste
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Literal data file name marking a paste of several files packed as a tar
+// archive.
+const archiveFileName = "antipaste.tar"
+
+// Whether the inputs to a paste need packing into an archive: more than
+// one of them, or a directory.
+func needsArchive(fileNames []string) bool {
+	if len(fileNames) != 1 {
+		return true
+	}
+	info, err := os.Stat(fileNames[0])
+	return err == nil && info.IsDir()
+}
+
+// Write files and directories to a tar archive, named by their paths
+// relative to the parent of each input. Anything other than regular files
+// and directories is skipped.
+func writeArchive(w io.Writer, fileNames []string) error {
+	tw := tar.NewWriter(w)
+	for _, fileName := range fileNames {
+		parent := filepath.Dir(filepath.Clean(fileName))
+		err := filepath.Walk(fileName, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() && !info.IsDir() {
+				fmt.Fprintf(os.Stderr, "Warning: skipping %s, not a regular file\n", filePath)
+				return nil
+			}
+			name, err := filepath.Rel(parent, filePath)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Extract a tar archive into a directory. Entries that would land outside
+// of it are refused, existing files are never overwritten, and only regular
+// files and directories are created. Returns the paths created.
+func extractArchive(dir string, r io.Reader) ([]string, error) {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	extracted := []string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return extracted, nil
+		} else if err != nil {
+			return nil, err
+		}
+		target, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode | 0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(target, mode, tr)
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s, not a regular file\n", hdr.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", target)
+		extracted = append(extracted, target)
+	}
+}
+
+// Where an archive entry goes under dir, refusing absolute paths and
+// parent directory references.
+func extractPath(dir string, name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") ||
+			strings.Contains(name, "\\") {
+		return "", newError(ErrDecryptFailed, "Refusing to extract unsafe path: %s", name)
+	}
+	target := filepath.Join(dir, filepath.FromSlash(clean))
+	if target != dir && !strings.HasPrefix(target, dir + string(filepath.Separator)) {
+		return "", newError(ErrDecryptFailed, "Refusing to extract unsafe path: %s", name)
+	}
+	return target, nil
+}
+
+func extractFile(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE | os.O_WRONLY | os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
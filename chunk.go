@@ -0,0 +1,132 @@
+package antipaste
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"github.com/cmars/go.crypto/openpgp/armor"
+)
+
+var chunkSize = putFlags.Int("chunk-size", 0, "Split pastes into chunks of at most this many bytes of ciphertext")
+
+// Literal data file name marking a paste that lists the chunks holding
+// the actual paste.
+const manifestFileName = "antipaste.manifest"
+
+// Armor block type of a chunk of ciphertext.
+const chunkBlockType = "ANTIPASTE CHUNK"
+
+// The chunks of a paste, in order. Manifests are encrypted and signed like
+// any other paste, so the hashes vouch for the chunks.
+type chunkManifest struct {
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+type manifestChunk struct {
+	Uri string `json:"uri"`
+	Sha256 string `json:"sha256"`
+}
+
+// Post ciphertext as a series of pastes of at most size bytes each, every
+// one ASCII-armored on its own.
+func writeChunks(ctx context.Context, handler ProtocolHandler, r io.Reader, size int,
+		progress *Progress) (*chunkManifest, error) {
+	manifest := &chunkManifest{ Chunks: []manifestChunk{} }
+	buf := make([]byte, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			armored := bytes.NewBuffer(nil)
+			armorOut, armorErr := armor.Encode(armored, chunkBlockType, map[string]string{
+				"Chunk": strconv.Itoa(len(manifest.Chunks) + 1) })
+			if armorErr != nil {
+				return nil, armorErr
+			}
+			armorOut.Write(buf[:n])
+			armorOut.Close()
+			uri, pasteErr := handler.WritePaste(ctx, armored)
+			if pasteErr != nil {
+				return nil, pasteErr
+			}
+			sum := sha256.Sum256(buf[:n])
+			manifest.Chunks = append(manifest.Chunks,
+				manifestChunk{ Uri: uri, Sha256: hex.EncodeToString(sum[:]) })
+			progress.Done()
+			fmt.Fprintf(os.Stderr, "Chunk %d: %s\n", len(manifest.Chunks), uri)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return manifest, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Fetch the chunks listed in a manifest, checking each against its hash,
+// and join them back up into the ciphertext of the paste. The chunks are
+// also copied to downloaded as they are read.
+func readChunks(ctx context.Context, manifest *chunkManifest, config *Config,
+		downloaded io.Writer) (io.Reader, error) {
+	if len(manifest.Chunks) == 0 {
+		return nil, newError(ErrDecryptFailed, "Manifest lists no chunks")
+	}
+	ciphertext := bytes.NewBuffer(nil)
+	for i, chunk := range manifest.Chunks {
+		data, err := readChunk(ctx, chunk.Uri, config, downloaded)
+		if err != nil {
+			kind := ErrorKind(err)
+			if kind == nil {
+				kind = ErrNotFound
+			}
+			return nil, newError(kind, "Chunk %d: %v", i + 1, err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != chunk.Sha256 {
+			return nil, newError(ErrBadSignature, "Chunk %d: hash mismatch, %s was modified", i + 1, chunk.Uri)
+		}
+		ciphertext.Write(data)
+	}
+	return ciphertext, nil
+}
+
+func readChunk(ctx context.Context, uri string, config *Config, downloaded io.Writer) ([]byte, error) {
+	protocol, target, err := parseUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := NewHandler(protocol, config)
+	if err != nil {
+		return nil, err
+	}
+	r, err := handler.ReadPaste(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	block, err := armor.Decode(io.TeeReader(r, downloaded))
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != chunkBlockType {
+		return nil, newError(ErrNotFound, "Not a paste chunk: %s", uri)
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err = io.Copy(buf, block.Body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseManifest(data []byte) (*chunkManifest, error) {
+	manifest := &chunkManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, newError(ErrDecryptFailed, "Invalid chunk manifest: %v", err)
+	}
+	return manifest, nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"github.com/cmars/antipaste"
 )
@@ -10,8 +9,8 @@ func main() {
 	app := antipaste.NewApp()
 	err := app.Run()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		antipaste.PrintError(err)
+		os.Exit(antipaste.ExitCode(err))
 	}
 	os.Exit(0)
 }
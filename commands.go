@@ -0,0 +1,451 @@
+package antipaste
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A command of the antipaste command line, such as get or key new.
+type Command struct {
+	Name string
+	// Other names the command can be run by
+	Aliases []string
+	// Arguments taken, shown in usage
+	Args string
+	// One line description, shown in command lists
+	Summary string
+	// Longer description, shown by help
+	Help string
+	Examples []string
+	// Flags of the command alone; global flags are accepted too
+	Flags *flag.FlagSet
+	// Number of arguments taken after the flags, MaxArgs -1 for any
+	MinArgs int
+	MaxArgs int
+	Run func(app *App, args []string) error
+	// Commands grouped under this one, which has no Run of its own
+	Subcommands []*Command
+	// Full name, such as "key new"
+	path string
+}
+
+// Flags of each command.
+var getFlags = commandFlags("get")
+var putFlags = commandFlags("put")
+var keyFindFlags = commandFlags("key find")
+var keyImportFlags = commandFlags("key import")
+var keyListFlags = commandFlags("key list")
+var keyDeleteFlags = commandFlags("key delete")
+var keyTrustFlags = commandFlags("key trust")
+var historyFlags = commandFlags("history")
+var agentFlags = commandFlags("agent")
+var completionFlags = commandFlags("completion")
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		&Command{
+			Name: "get",
+			Args: "<uri>",
+			Summary: "Fetch, decrypt and verify a paste",
+			Help: "Writes the paste to standard output, or unpacks it into a directory with\n" +
+				"-extract. The URI is one printed by put, or a web page or file holding\n" +
+				"an armored paste. Fails if the paste is signed by a key that is unknown\n" +
+				"or whose signature does not verify.",
+			Examples: []string{
+				"antipaste get dpaste:aB3xY",
+				"antipaste get -extract ./notes gist:0123456789abcdef",
+				"antipaste get 'file:/tmp/paste.asc#k=Zm9vYmFy'" },
+			Flags: getFlags,
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: (*App).cmdGet },
+		&Command{
+			Name: "put",
+			Args: "<dest>[,<dest>...]|default <file|dir|-> [...] [--] [<id|@group> ...]",
+			Summary: "Encrypt, sign and post a paste",
+			Help: "Encrypts files to the recipients given, and to your own keys unless\n" +
+				"-no-self is given, signs them with your secret key and posts them to each\n" +
+				"destination protocol, printing the URI of the paste. Several files or a\n" +
+				"directory are posted as a tar archive. Recipients are fingerprint\n" +
+				"suffixes of at least 8 hex digits or prefixed with 0x, user ID\n" +
+				"substrings or @groups from the config file, following -- or else the\n" +
+				"last file. With -symmetric or -link no recipients are taken.\n" +
+				"Run antipaste help for the protocols.",
+			Examples: []string{
+				"antipaste put dpaste notes.txt alice@example.com",
+				"antipaste put -expire 24h gist,dpaste ./logs @oncall",
+				"antipaste put dpaste a.txt b.txt -- bob",
+				"echo secret | antipaste put -link default -" },
+			Flags: putFlags,
+			MinArgs: 2,
+			MaxArgs: -1,
+			Run: (*App).cmdPut },
+		&Command{
+			Name: "delete",
+			Args: "<uri>",
+			Summary: "Delete a paste where it was posted",
+			Examples: []string{
+				"antipaste delete pb:aB3xY" },
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: (*App).cmdDelete },
+		&Command{
+			Name: "key",
+			Summary: "Manage keys and key rings",
+			Subcommands: []*Command{
+				&Command{
+					Name: "new",
+					Args: "<name> <email> <comment>",
+					Summary: "Generate a new key pair",
+					Examples: []string{
+						"antipaste key new 'Alice Example' alice@example.com work" },
+					MinArgs: 3,
+					MaxArgs: 3,
+					Run: (*App).cmdKeyNew },
+				&Command{
+					Name: "find",
+					Args: "<query>",
+					Summary: "Search keyservers for keys",
+					Help: "Searches the keyserver given with -hkp, or else those in the config file.",
+					Examples: []string{
+						"antipaste key find alice@example.com" },
+					Flags: keyFindFlags,
+					MinArgs: 1,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyFind },
+				&Command{
+					Name: "import",
+					Args: "<fingerprint> | -file <path>",
+					Summary: "Import a key from a keyserver or a file",
+					Examples: []string{
+						"antipaste key import 0123456789ABCDEF0123456789ABCDEF01234567",
+						"antipaste key import -file alice.asc" },
+					Flags: keyImportFlags,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyImport },
+				&Command{
+					Name: "list",
+					Summary: "List public keys, or secret keys with -secret",
+					Flags: keyListFlags,
+					Run: (*App).cmdKeyList },
+				&Command{
+					Name: "export",
+					Args: "<id>",
+					Summary: "Write a public key to standard output, ASCII-armored",
+					Help: "With -json, the armored key is given along with a description of it.",
+					MinArgs: 1,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyExport },
+				&Command{
+					Name: "delete",
+					Args: "<id>",
+					Summary: "Delete a public key, or a secret key too with -secret",
+					Flags: keyDeleteFlags,
+					MinArgs: 1,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyDelete },
+				&Command{
+					Name: "trust",
+					Args: "<id>",
+					Summary: "Trust a public key to speak for its user IDs, or stop with -remove",
+					Help: "Good signatures from keys that are neither trusted nor your own are\n" +
+						"reported by get as from a key not trusted.",
+					Examples: []string{
+						"antipaste key trust alice@example.com",
+						"antipaste key trust -remove alice@example.com" },
+					Flags: keyTrustFlags,
+					MinArgs: 1,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyTrust },
+				&Command{
+					Name: "passwd",
+					Args: "<id>",
+					Summary: "Change the passphrase of a secret key",
+					MinArgs: 1,
+					MaxArgs: 1,
+					Run: (*App).cmdKeyPasswd } } },
+		&Command{
+			Name: "history",
+			Args: "[<term> ...] | -prune [-remote]",
+			Summary: "List the pastes you made, or prune expired ones",
+			Help: "Lists pastes newest first, only those matching all the terms given: part\n" +
+				"of a URI or file name, a protocol or a recipient. With -prune, expired\n" +
+				"pastes are removed from the history instead.",
+			Examples: []string{
+				"antipaste history alice gist",
+				"antipaste history -prune -remote" },
+			Flags: historyFlags,
+			MaxArgs: -1,
+			Run: (*App).cmdHistory },
+		&Command{
+			Name: "agent",
+			Aliases: []string{"serve"},
+			Summary: "Run the agent, which keeps keys unlocked for other commands",
+			Help: "Serves on a socket in the antipaste home directory until interrupted.\n" +
+				"With -json, the socket is printed once the agent is listening.",
+			Flags: agentFlags,
+			Run: (*App).cmdAgent },
+		&Command{
+			Name: "completion",
+			Args: "bash|zsh|fish",
+			Summary: "Print a shell completion script",
+			Help: "The script completes commands, flags, protocols and known recipients.\n" +
+				"It is printed as it is with -json, while -list prints a JSON array.",
+			Examples: []string{
+				"source <(antipaste completion bash)",
+				"antipaste completion fish | source" },
+			Flags: completionFlags,
+			MaxArgs: 1,
+			Run: (*App).cmdCompletion },
+		&Command{
+			Name: "help",
+			Args: "[<command> ...]",
+			Summary: "Show help for a command",
+			MaxArgs: -1,
+			Run: (*App).cmdHelp } }
+	setCommandPaths(commands, "")
+}
+
+func commandFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func setCommandPaths(cmds []*Command, parent string) {
+	for _, cmd := range cmds {
+		cmd.path = strings.TrimSpace(parent + " " + cmd.Name)
+		setCommandPaths(cmd.Subcommands, cmd.path)
+	}
+}
+
+// Find the command named by the leading arguments, returning the rest.
+func findCommand(args []string) (*Command, []string) {
+	var found *Command
+	cmds := commands
+	for len(args) > 0 {
+		var next *Command
+		for _, cmd := range cmds {
+			if cmd.Name == args[0] || cmd.hasAlias(args[0]) {
+				next = cmd
+			}
+		}
+		if next == nil {
+			break
+		}
+		found, cmds, args = next, next.Subcommands, args[1:]
+	}
+	return found, args
+}
+
+func (cmd *Command) hasAlias(name string) bool {
+	for _, alias := range cmd.Aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Full names of a command, its path and those of its aliases.
+func (cmd *Command) paths() []string {
+	paths := []string{cmd.path}
+	for _, alias := range cmd.Aliases {
+		paths = append(paths, strings.TrimSuffix(cmd.path, cmd.Name) + alias)
+	}
+	return paths
+}
+
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+// Whether a flag is given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	has := false
+	if fs != nil {
+		fs.VisitAll(func(*flag.Flag) { has = true })
+	}
+	return has
+}
+
+// Names of the commands in a list.
+func commandNames(cmds []*Command) []string {
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+// Parse a command's flags, along with any global flags given after the
+// command name, returning the remaining arguments.
+func (cmd *Command) parse(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(cmd.path, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	add := func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	if cmd.Flags != nil {
+		cmd.Flags.VisitAll(add)
+	}
+	flag.VisitAll(add)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	// Protocol handler options are looked up among the global flags set
+	fs.Visit(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) != nil {
+			flag.Set(f.Name, f.Value.String())
+		}
+	})
+	return fs.Args(), nil
+}
+
+// One line usage of a command.
+func (cmd *Command) usage() string {
+	if len(cmd.Subcommands) > 0 {
+		return fmt.Sprintf("Usage: antipaste %s %s [flags] [arguments]",
+			cmd.path, strings.Join(commandNames(cmd.Subcommands), "|"))
+	}
+	usage := "Usage: antipaste " + cmd.path
+	if hasFlags(cmd.Flags) {
+		usage += " [flags]"
+	}
+	if cmd.Args != "" {
+		usage += " " + cmd.Args
+	}
+	return usage
+}
+
+// Error for bad arguments to a command.
+func (cmd *Command) usageError(format string, args ...interface{}) error {
+	return newError(ErrUsage, "%s\n%s", fmt.Sprintf(format, args...), cmd.usage())
+}
+
+func (cmd *Command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "%s\n\n", cmd.usage())
+	fmt.Fprintf(w, "%s.\n", cmd.Summary)
+	if cmd.Help != "" {
+		fmt.Fprintf(w, "\n%s\n", cmd.Help)
+	}
+	if len(cmd.Aliases) > 0 {
+		fmt.Fprintf(w, "\nAlso run as: %s\n", strings.Join(cmd.Aliases, ", "))
+	}
+	if len(cmd.Subcommands) > 0 {
+		fmt.Fprintf(w, "\nCommands:\n")
+		printCommandList(w, cmd.Subcommands)
+	}
+	if hasFlags(cmd.Flags) {
+		fmt.Fprintf(w, "\nFlags:\n")
+		cmd.Flags.SetOutput(w)
+		cmd.Flags.PrintDefaults()
+	}
+	if len(cmd.Examples) > 0 {
+		fmt.Fprintf(w, "\nExamples:\n")
+		for _, example := range cmd.Examples {
+			fmt.Fprintf(w, "  %s\n", example)
+		}
+	}
+	fmt.Fprintf(w, "\nRun antipaste help for the global flags.\n")
+}
+
+func printCommandList(w io.Writer, cmds []*Command) {
+	for _, cmd := range cmds {
+		summary := cmd.Summary
+		if len(cmd.Aliases) > 0 {
+			summary += fmt.Sprintf(" (also %s)", strings.Join(cmd.Aliases, ", "))
+		}
+		fmt.Fprintf(w, "  %-12s%s\n", cmd.Name, summary)
+	}
+}
+
+// Short usage of antipaste as a whole.
+func usage() string {
+	return fmt.Sprintf("Usage: antipaste [flags] %s [arguments], antipaste help <command> for more",
+		strings.Join(commandNames(commands), "|"))
+}
+
+// Protocol handler names, sorted.
+func protocolNames() []string {
+	names := []string{}
+	for name := range handlerRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Print help on antipaste as a whole: its commands, protocols and global
+// flags.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: antipaste [flags] <command> [flags] [arguments]\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	printCommandList(w, commands)
+	fmt.Fprintf(w, "\nRun antipaste help <command> for the flags and arguments of each.\n")
+	fmt.Fprintf(w, "\nProtocols: %s\n", strings.Join(protocolNames(), ", "))
+	fmt.Fprintf(w, "\nGlobal flags, accepted before or after the command:\n")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
+
+// Run the command given on the command line.
+func (app *App) Run() error {
+	flag.CommandLine.Init("antipaste", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+	err := flag.CommandLine.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		printUsage(os.Stdout)
+		return nil
+	} else if err != nil {
+		return newError(ErrUsage, "%v\n%s", err, usage())
+	}
+	cmd, args := findCommand(flag.Args())
+	if cmd == nil {
+		if flag.NArg() == 0 {
+			return newError(ErrUsage, "%s", usage())
+		}
+		return newError(ErrUsage, "Unknown command: %s\n%s", flag.Arg(0), usage())
+	}
+	if cmd.Run == nil {
+		if len(args) > 0 && isHelpFlag(args[0]) {
+			cmd.printHelp(os.Stdout)
+			return nil
+		} else if len(args) > 0 {
+			return cmd.usageError("Unknown command: %s %s", cmd.path, args[0])
+		}
+		return newError(ErrUsage, "%s", cmd.usage())
+	}
+	args, err = cmd.parse(args)
+	if err == flag.ErrHelp {
+		cmd.printHelp(os.Stdout)
+		return nil
+	} else if err != nil {
+		return cmd.usageError("%v", err)
+	}
+	if len(args) < cmd.MinArgs {
+		return cmd.usageError("Too few arguments")
+	} else if cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs {
+		return cmd.usageError("Too many arguments")
+	}
+	if cmd.Name != "help" {
+		cancel, err := app.setup()
+		if err != nil {
+			return err
+		}
+		defer cancel()
+	}
+	return cmd.Run(app, args)
+}
@@ -0,0 +1,426 @@
+package antipaste
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var completionList = completionFlags.String("list", "", "Print candidates for completion, protocols or recipients, as the scripts do")
+
+func (app *App) cmdCompletion(args []string) error {
+	if *completionList != "" {
+		if len(args) > 0 {
+			return newError(ErrUsage, "No shell is given with -list")
+		}
+		return app.listCompletions(os.Stdout, *completionList)
+	}
+	if len(args) == 0 {
+		return newError(ErrUsage, "Usage: antipaste completion bash|zsh|fish")
+	}
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	default:
+		return newError(ErrUsage, "Unsupported shell: %s", args[0])
+	}
+	return nil
+}
+
+// Print the candidates for completing protocols or recipients, one a line.
+func (app *App) listCompletions(w io.Writer, kind string) error {
+	var candidates []string
+	switch kind {
+	case "protocols":
+		candidates = protocolNames()
+	case "recipients":
+		candidates = app.recipientCandidates()
+	default:
+		return newError(ErrUsage, "Nothing to list for completion: %s", kind)
+	}
+	if *jsonOutput {
+		return writeJson(candidates)
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\n", candidate)
+	}
+	return nil
+}
+
+// Recipients known to complete: the email addresses of each public key, or
+// its fingerprint if it has none, and the groups in the config file.
+func (app *App) recipientCandidates() []string {
+	seen := make(map[string]bool)
+	for _, entity := range app.pgp.PubRing {
+		found := false
+		for _, ident := range entity.Identities {
+			if ident.UserId != nil && ident.UserId.Email != "" {
+				seen[ident.UserId.Email] = true
+				found = true
+			}
+		}
+		if !found {
+			fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+			seen[fingerprint] = true
+		}
+	}
+	for name := range app.config.Groups {
+		seen["@" + name] = true
+	}
+	result := []string{}
+	for candidate := range seen {
+		result = append(result, candidate)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Commands which can be run, rather than only grouping others.
+func runnableCommands(cmds []*Command) []*Command {
+	result := []*Command{}
+	for _, cmd := range cmds {
+		if cmd.Run != nil {
+			result = append(result, cmd)
+		}
+		result = append(result, runnableCommands(cmd.Subcommands)...)
+	}
+	return result
+}
+
+// Commands with subcommands.
+func groupCommands() []*Command {
+	result := []*Command{}
+	for _, cmd := range commands {
+		if len(cmd.Subcommands) > 0 {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+// Names of commands to complete, aliases included.
+func completionNames(cmds []*Command) []string {
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name)
+		names = append(names, cmd.Aliases...)
+	}
+	return names
+}
+
+// A command's full names quoted for a case pattern, separated by |.
+func casePattern(cmd *Command) string {
+	quoted := []string{}
+	for _, path := range cmd.paths() {
+		quoted = append(quoted, fmt.Sprintf("%q", path))
+	}
+	return strings.Join(quoted, "|")
+}
+
+func flagNames(fs *flag.FlagSet) []string {
+	names := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-" + f.Name)
+	})
+	return names
+}
+
+// Flags accepted by a command, its own then the global ones.
+func commandFlagNames(cmd *Command) []string {
+	names := []string{}
+	if cmd.Flags != nil {
+		names = append(names, flagNames(cmd.Flags)...)
+	}
+	return append(names, flagNames(flag.CommandLine)...)
+}
+
+// Every flag which takes a value, so that the scripts can skip the values
+// when finding the command and counting its arguments.
+func valueFlagNames() []string {
+	seen := make(map[string]bool)
+	add := func(f *flag.Flag) {
+		if !isBoolFlag(f) {
+			seen["-" + f.Name] = true
+		}
+	}
+	flag.VisitAll(add)
+	for _, cmd := range runnableCommands(commands) {
+		if cmd.Flags != nil {
+			cmd.Flags.VisitAll(add)
+		}
+	}
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeBashCompletion(w io.Writer) {
+	flagCases := ""
+	for _, cmd := range runnableCommands(commands) {
+		flagCases += fmt.Sprintf("\t\t%s)\n\t\t\topts=\"%s\" ;;\n",
+			casePattern(cmd), strings.Join(commandFlagNames(cmd), " "))
+	}
+	groupCases := ""
+	for _, cmd := range groupCommands() {
+		groupCases += fmt.Sprintf("\t%s)\n\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n",
+			casePattern(cmd), strings.Join(completionNames(cmd.Subcommands), " "))
+	}
+	fmt.Fprintf(w, bashCompletion,
+		strings.Join(valueFlagNames(), "|"),
+		strings.Join(completionNames(groupCommands()), " "),
+		flagCases,
+		strings.Join(flagNames(flag.CommandLine), " "),
+		strings.Join(completionNames(commands), " "),
+		groupCases)
+}
+
+func writeZshCompletion(w io.Writer) {
+	flagCases := ""
+	for _, cmd := range runnableCommands(commands) {
+		flagCases += fmt.Sprintf("\t\t(%s)\n\t\t\topts=(%s) ;;\n",
+			casePattern(cmd), strings.Join(commandFlagNames(cmd), " "))
+	}
+	groupCases := ""
+	for _, cmd := range groupCommands() {
+		groupCases += fmt.Sprintf("\t(%s)\n\t\tcompadd -- %s ;;\n",
+			casePattern(cmd), strings.Join(completionNames(cmd.Subcommands), " "))
+	}
+	fmt.Fprintf(w, zshCompletion,
+		strings.Join(valueFlagNames(), "|"),
+		strings.Join(completionNames(groupCommands()), " "),
+		flagCases,
+		strings.Join(flagNames(flag.CommandLine), " "),
+		strings.Join(completionNames(commands), " "),
+		groupCases)
+}
+
+// Quote a string for fish.
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "'", "\\'", -1) + "'"
+}
+
+// Fish completions for the flags of a command, or the global flags if
+// condition is empty.
+func fishFlagCompletions(w io.Writer, fs *flag.FlagSet, condition string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "complete -c antipaste")
+		if condition != "" {
+			fmt.Fprintf(w, " -n %s", fishQuote(condition))
+		}
+		fmt.Fprintf(w, " -o %s", f.Name)
+		if !isBoolFlag(f) {
+			fmt.Fprintf(w, " -r -F")
+		}
+		fmt.Fprintf(w, " -d %s\n", fishQuote(f.Usage))
+	})
+}
+
+// A fish condition for being at a command, under any of its names.
+func fishAt(cmd *Command) string {
+	return "__antipaste_at " + strings.Replace(casePattern(cmd), "|", " ", -1)
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, fishCompletion,
+		strings.Join(valueFlagNames(), " "),
+		strings.Join(completionNames(groupCommands()), " "))
+	for _, cmd := range commands {
+		for _, name := range completionNames([]*Command{cmd}) {
+			fmt.Fprintf(w, "complete -c antipaste -n '__antipaste_at \"\"' -a %s -d %s\n",
+				name, fishQuote(cmd.Summary))
+			fmt.Fprintf(w, "complete -c antipaste -n '__antipaste_at help' -a %s -d %s\n",
+				name, fishQuote(cmd.Summary))
+		}
+		for _, sub := range cmd.Subcommands {
+			for _, name := range completionNames([]*Command{sub}) {
+				fmt.Fprintf(w, "complete -c antipaste -n %s -a %s -d %s\n",
+					fishQuote(fishAt(cmd)), name, fishQuote(sub.Summary))
+			}
+		}
+	}
+	fishFlagCompletions(w, flag.CommandLine, "")
+	for _, cmd := range runnableCommands(commands) {
+		if cmd.Flags != nil {
+			fishFlagCompletions(w, cmd.Flags, fishAt(cmd))
+		}
+	}
+}
+
+// Completion scripts, filled in with value flags, commands with
+// subcommands and, for bash and zsh, the flags of each command, the global
+// flags, the top level commands and the subcommands of each group.
+
+const bashCompletion = `# bash completion for antipaste, load with: source <(antipaste completion bash)
+_antipaste() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local cmd="" npos=0 word opts i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		word="${COMP_WORDS[i]}"
+		case "$word" in
+		%[1]s)
+			((i++)) ;;
+		-*)
+			;;
+		*)
+			if [[ -z "$cmd" ]]; then
+				cmd="$word"
+			elif [[ $npos -eq 0 && " %[2]s " == *" $cmd "* ]]; then
+				cmd="$cmd $word"
+			else
+				((npos++))
+			fi ;;
+		esac
+	done
+	case "$prev" in
+	%[1]s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return ;;
+	esac
+	if [[ "$cur" == -* ]]; then
+		case "$cmd" in
+%[3]s		*)
+			opts="%[4]s" ;;
+		esac
+		COMPREPLY=($(compgen -W "$opts" -- "$cur"))
+		return
+	fi
+	case "$cmd" in
+	"")
+		COMPREPLY=($(compgen -W "%[5]s" -- "$cur")) ;;
+%[6]s	help)
+		COMPREPLY=($(compgen -W "%[5]s" -- "$cur")) ;;
+	completion)
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")) ;;
+	get|delete)
+		COMPREPLY=($(compgen -W "$(antipaste completion -list protocols 2>/dev/null | sed 's/$/:/')" -- "$cur")
+			$(compgen -f -- "$cur")) ;;
+	put)
+		if [[ $npos -eq 0 ]]; then
+			COMPREPLY=($(compgen -W "default $(antipaste completion -list protocols 2>/dev/null)" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "$(antipaste completion -list recipients 2>/dev/null)" -- "$cur")
+				$(compgen -f -- "$cur"))
+		fi ;;
+	"key export"|"key delete"|"key trust"|"key passwd")
+		COMPREPLY=($(compgen -W "$(antipaste completion -list recipients 2>/dev/null)" -- "$cur")) ;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur")) ;;
+	esac
+}
+complete -o filenames -F _antipaste antipaste
+`
+
+const zshCompletion = `#compdef antipaste
+# zsh completion for antipaste, load with: source <(antipaste completion zsh)
+_antipaste() {
+	local cmd="" word i
+	local -i npos=0
+	local -a opts protocols recipients
+	for ((i = 2; i < CURRENT; i++)); do
+		word="${words[i]}"
+		case "$word" in
+		(%[1]s)
+			((i++)) ;;
+		(-*)
+			;;
+		(*)
+			if [[ -z "$cmd" ]]; then
+				cmd="$word"
+			elif ((npos == 0)) && [[ " %[2]s " == *" $cmd "* ]]; then
+				cmd="$cmd $word"
+			else
+				((npos++))
+			fi ;;
+		esac
+	done
+	case "${words[CURRENT-1]}" in
+	(%[1]s)
+		_files
+		return ;;
+	esac
+	if [[ "${words[CURRENT]}" == -* ]]; then
+		case "$cmd" in
+%[3]s		(*)
+			opts=(%[4]s) ;;
+		esac
+		compadd -- $opts
+		return
+	fi
+	case "$cmd" in
+	("")
+		compadd -- %[5]s ;;
+%[6]s	(help)
+		compadd -- %[5]s ;;
+	(completion)
+		compadd -- bash zsh fish ;;
+	(get|delete)
+		protocols=(${(f)"$(antipaste completion -list protocols 2>/dev/null)"})
+		compadd -S : -- $protocols
+		_files ;;
+	(put)
+		if ((npos == 0)); then
+			protocols=(${(f)"$(antipaste completion -list protocols 2>/dev/null)"})
+			compadd -- default $protocols
+		else
+			recipients=(${(f)"$(antipaste completion -list recipients 2>/dev/null)"})
+			compadd -- $recipients
+			_files
+		fi ;;
+	("key export"|"key delete"|"key trust"|"key passwd")
+		recipients=(${(f)"$(antipaste completion -list recipients 2>/dev/null)"})
+		compadd -- $recipients ;;
+	(*)
+		_files ;;
+	esac
+}
+compdef _antipaste antipaste
+`
+
+const fishCompletion = `# fish completion for antipaste, load with: antipaste completion fish | source
+function __antipaste_parse
+	set -g __antipaste_cmd ""
+	set -g __antipaste_npos 0
+	set -l tokens (commandline -opc)
+	set -l skip 0
+	for token in $tokens[2..-1]
+		if test $skip -eq 1
+			set skip 0
+		else if contains -- $token %[1]s
+			set skip 1
+		else if string match -q -- '-*' $token
+			continue
+		else if test -z "$__antipaste_cmd"
+			set __antipaste_cmd $token
+		else if test $__antipaste_npos -eq 0; and contains -- $__antipaste_cmd %[2]s
+			set __antipaste_cmd "$__antipaste_cmd $token"
+		else
+			set __antipaste_npos (math $__antipaste_npos + 1)
+		end
+	end
+end
+
+function __antipaste_at
+	__antipaste_parse; and contains -- "$__antipaste_cmd" $argv
+end
+
+function __antipaste_list
+	antipaste completion -list $argv[1] 2>/dev/null
+end
+
+complete -c antipaste -f
+complete -c antipaste -n '__antipaste_at completion' -a 'bash zsh fish'
+complete -c antipaste -n '__antipaste_at get delete' -F -a '(__antipaste_list protocols | string replace -r "\$" :)'
+complete -c antipaste -n '__antipaste_at put; and test $__antipaste_npos -eq 0' -a 'default (__antipaste_list protocols)'
+complete -c antipaste -n '__antipaste_at put; and test $__antipaste_npos -gt 0' -F -a '(__antipaste_list recipients)'
+complete -c antipaste -n '__antipaste_at "key export" "key delete" "key trust" "key passwd"' -a '(__antipaste_list recipients)'
+`
@@ -0,0 +1,179 @@
+package antipaste
+
+import (
+	"compress/flate"
+	"io"
+	"github.com/cmars/go.crypto/openpgp"
+	"github.com/cmars/go.crypto/openpgp/packet"
+)
+
+var compressFlag = putFlags.String("compress", "zlib", "Compress pastes before encryption: zlib, zip or none")
+var compressLevel = putFlags.Int("compress-level", flate.DefaultCompression, "Compression level, 1 (fastest) to 9 (best)")
+
+var compressionAlgos map[string]packet.CompressionAlgo = map[string]packet.CompressionAlgo{
+	"none": packet.CompressionNone,
+	"zip": packet.CompressionZIP,
+	"zlib": packet.CompressionZLIB,
+}
+
+// Parse the -compress and -compress-level flags.
+func compression() (packet.CompressionAlgo, *packet.CompressionConfig, error) {
+	algo, has := compressionAlgos[*compressFlag]
+	if !has {
+		return 0, nil, newError(ErrUsage, "Unknown compression algorithm: %s", *compressFlag)
+	}
+	level := *compressLevel
+	if level != flate.DefaultCompression && (level < flate.BestSpeed || level > flate.BestCompression) {
+		return 0, nil, newError(ErrUsage, "Invalid compression level: %d", level)
+	}
+	return algo, &packet.CompressionConfig{ Level: level }, nil
+}
+
+// Choose a compression algorithm every recipient can read. The requested
+// algorithm is used if they all accept it, otherwise the first other one
+// in the author's order of preference that they do, or none at all.
+// Recipients stating no preferences accept anything.
+func negotiateCompression(requested packet.CompressionAlgo, recipients []*openpgp.Entity) packet.CompressionAlgo {
+	if requested == packet.CompressionNone {
+		return requested
+	}
+	candidates := []packet.CompressionAlgo{ requested, packet.CompressionZLIB, packet.CompressionZIP }
+	for _, algo := range candidates {
+		accepted := true
+		for _, recipient := range recipients {
+			if !acceptsCompression(recipient, algo) {
+				accepted = false
+				break
+			}
+		}
+		if accepted {
+			return algo
+		}
+	}
+	return packet.CompressionNone
+}
+
+// Whether a key's self-signature lists a compression algorithm among its
+// preferences.
+func acceptsCompression(entity *openpgp.Entity, algo packet.CompressionAlgo) bool {
+	ident, has := entity.Identities[primaryUid(entity)]
+	if !has || ident.SelfSignature == nil || len(ident.SelfSignature.PreferredCompression) == 0 {
+		return true
+	}
+	for _, pref := range ident.SelfSignature.PreferredCompression {
+		if packet.CompressionAlgo(pref) == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the packet config used to encrypt a paste to recipients.
+func compressionConfig(recipients []*openpgp.Entity) (*packet.Config, error) {
+	algo, compConfig, err := compression()
+	if err != nil {
+		return nil, err
+	}
+	return &packet.Config{
+		DefaultCompressionAlgo: negotiateCompression(algo, recipients),
+		CompressionConfig: compConfig }, nil
+}
+
+// Symmetric ciphers we encrypt with, in order of preference. CAST5 is
+// assumed for recipients stating no preferences.
+var candidateCiphers []packet.CipherFunction = []packet.CipherFunction{
+	packet.CipherAES128, packet.CipherAES256, packet.CipherCAST5 }
+
+// Choose the first candidate cipher every recipient accepts.
+func negotiateCipher(recipients []*openpgp.Entity) (packet.CipherFunction, error) {
+	for _, cipher := range candidateCiphers {
+		accepted := true
+		for _, recipient := range recipients {
+			var prefs []uint8
+			if ident, has := recipient.Identities[primaryUid(recipient)]; has && ident.SelfSignature != nil {
+				prefs = ident.SelfSignature.PreferredSymmetric
+			}
+			if len(prefs) == 0 {
+				prefs = []uint8{ uint8(packet.CipherCAST5) }
+			}
+			found := false
+			for _, pref := range prefs {
+				if packet.CipherFunction(pref) == cipher {
+					found = true
+				}
+			}
+			if !found {
+				accepted = false
+				break
+			}
+		}
+		if accepted {
+			return cipher, nil
+		}
+	}
+	return 0, newError(ErrUnknownRecipient, "Recipients share no common cipher")
+}
+
+// Encrypt to recipients with the literal data, and signature if any,
+// compressed inside the encrypted data. openpgp.Encrypt does not compress,
+// so the message is put together here.
+func encryptCompressed(ciphertext io.Writer, recipients []*openpgp.Entity, signer *openpgp.Entity,
+		hints *openpgp.FileHints, config *packet.Config) (io.WriteCloser, error) {
+	cipher, err := negotiateCipher(recipients)
+	if err != nil {
+		return nil, err
+	}
+	symKey := make([]byte, cipher.KeySize())
+	if _, err = io.ReadFull(config.Random(), symKey); err != nil {
+		return nil, err
+	}
+	for _, recipient := range recipients {
+		key := encryptionKey(recipient, config.Now())
+		if key == nil {
+			fingerprint, _ := FpToString(recipient.PrimaryKey.Fingerprint)
+			return nil, newError(ErrUnknownRecipient, "No encryption key for %s", fingerprint)
+		}
+		if err = packet.SerializeEncryptedKey(ciphertext, key, cipher, symKey, config); err != nil {
+			return nil, err
+		}
+	}
+	encrypted, err := packet.SerializeSymmetricallyEncrypted(ciphertext, cipher, symKey, config)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the compressed data closes the encrypted data around it
+	compressed, err := packet.SerializeCompressed(encrypted,
+		config.DefaultCompressionAlgo, config.CompressionConfig)
+	if err != nil {
+		return nil, err
+	}
+	if hints == nil {
+		hints = &openpgp.FileHints{}
+	}
+	if signer == nil {
+		var modTime uint32
+		if !hints.ModTime.IsZero() {
+			modTime = uint32(hints.ModTime.Unix())
+		}
+		return packet.SerializeLiteral(compressed, hints.IsBinary, hints.FileName, modTime)
+	}
+	signed, err := openpgp.Sign(compressed, signer, hints, config)
+	if err != nil {
+		return nil, err
+	}
+	return &signedWriter{ signed, compressed }, nil
+}
+
+// Closes the compressed data once the signature is written, which
+// openpgp.Sign leaves open.
+type signedWriter struct {
+	io.WriteCloser
+	compressed io.WriteCloser
+}
+
+func (sw *signedWriter) Close() error {
+	if err := sw.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return sw.compressed.Close()
+}
@@ -0,0 +1,93 @@
+package antipaste
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var configFlag = flag.String("config", "", "Antipaste config file (default: config.json in homedir)")
+
+// Keyserver used when none is configured.
+const DefaultKeyserver = "pgp.mit.edu"
+
+// Settings read from the antipaste config file, a JSON document like:
+//
+//	{
+//		"put": "gist",
+//		"keyservers": ["pgp.mit.edu", "keys.example.com:11371"],
+//		"groups": {"oncall": ["0123...cdef", "4567...89ab"]},
+//		"encrypt_to_self": true,
+//		"handlers": {"dpaste": {"expire": "86400"}}
+//	}
+type Config struct {
+	// Protocol used by put default
+	Put string `json:"put"`
+	// Keyservers as host[:port], tried in order
+	Keyservers []string `json:"keyservers"`
+	// Named sets of recipient key fingerprints
+	Groups map[string][]string `json:"groups"`
+	// Whether pastes are also encrypted to the author, true if unset
+	EncryptToSelf *bool `json:"encrypt_to_self"`
+	// Protocol handler option values, by handler then option name
+	Handlers map[string]map[string]string `json:"handlers"`
+}
+
+func configFile() (string, error) {
+	if *configFlag != "" {
+		return *configFlag, nil
+	}
+	basepath, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(basepath, "config.json"), nil
+}
+
+// Load the config file. A missing file is an empty config.
+func LoadConfig() (*Config, error) {
+	config := &Config{}
+	path, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, newError(ErrUsage, "Invalid config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Parse the configured keyservers.
+func (config *Config) keyservers() ([]Keyserver, error) {
+	result := []Keyserver{}
+	for _, uri := range config.Keyservers {
+		hkp, err := ParseHkpUri(uri)
+		if err != nil {
+			return nil, newError(ErrUsage, "Invalid keyserver %s: %v", uri, err)
+		}
+		result = append(result, Keyserver{ Hostname: hkp.Hostname, Port: hkp.Port })
+	}
+	return result, nil
+}
+
+// Whether pastes are also encrypted to the author's own keys.
+func (config *Config) encryptToSelf() bool {
+	return config.EncryptToSelf == nil || *config.EncryptToSelf
+}
+
+// Get a handler option from the config file.
+func (config *Config) handlerOption(handler string, option string) (string, bool) {
+	if config == nil {
+		return "", false
+	}
+	value, has := config.Handlers[handler][option]
+	return value, has
+}
@@ -1,84 +1,133 @@
 package antipaste
 
 import (
-	"errors"
-	"flag"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strings"
 	"strconv"
+	"strings"
+	"time"
 )
 
-var dpExpire = flag.String("dpaste-expire", "3600", "dpaste expiration (seconds)")
-var dpLexer = flag.String("dpaste-lexer", "text", "dpaste lexer")
-var dpTitle = flag.String("dpaste-title", "", "dpaste title")
 var dpPrefix = regexp.MustCompile("^dpaste:")
 
 type DpasteHandler struct {
-	Expire int
+	// An expire_options value: seconds from dpasteExpiries, never or onetime
+	Expire string
 	Lexer string
 	Title string
+	client *HttpClient
+}
+
+// Expiry periods dpaste offers, shortest first.
+var dpasteExpiries []time.Duration = []time.Duration{
+	time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
 }
 
 func init() {
-	ttl, err := strconv.ParseInt(*dpExpire, 10, 32)
+	Register("dpaste", NewDpasteHandler,
+		HandlerOption{ "expire", "3600",
+			"dpaste expiration: 3600, 604800 or 2592000 seconds, never or onetime" },
+		HandlerOption{ "lexer", "text", "dpaste lexer" },
+		HandlerOption{ "title", "", "dpaste title" })
+}
+
+func NewDpasteHandler(config *HandlerConfig) (ProtocolHandler, error) {
+	client, err := httpClient()
 	if err != nil {
-		ttl = 3600
+		return nil, err
 	}
 	dph := &DpasteHandler{
-		Expire: int(ttl),
-		Lexer: *dpLexer,
-		Title: *dpTitle }
-	protocolHandlers[dph.Prefix()] = dph
+		Expire: config.Get("expire"),
+		Lexer: config.Get("lexer"),
+		Title: config.Get("title"),
+		client: client }
+	if dph.Expire != "never" && dph.Expire != "onetime" {
+		ttl, err := config.GetInt("expire")
+		if err != nil {
+			return nil, err
+		}
+		if _, err = dph.SetExpiry(time.Duration(ttl) * time.Second); err != nil {
+			return nil, err
+		}
+	}
+	return dph, nil
 }
 
 func (dph *DpasteHandler) Prefix() string {
 	return "dpaste"
 }
 
-func (dph *DpasteHandler) ReadPaste(url string) (io.ReadCloser, error) {
+// Set the longest expiry dpaste offers that is no longer than ttl.
+func (dph *DpasteHandler) SetExpiry(ttl time.Duration) (time.Duration, error) {
+	var applied time.Duration
+	for _, expiry := range dpasteExpiries {
+		if expiry <= ttl {
+			applied = expiry
+		}
+	}
+	if applied == 0 {
+		return 0, newError(ErrUsage, "dpaste pastes can't expire sooner than %v", dpasteExpiries[0])
+	}
+	dph.Expire = fmt.Sprintf("%d", applied / time.Second)
+	return applied, nil
+}
+
+// The expiry of pastes written next, or 0 for never and onetime pastes.
+func (dph *DpasteHandler) Expiry() time.Duration {
+	seconds, err := strconv.Atoi(dph.Expire)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (dph *DpasteHandler) ReadPaste(ctx context.Context, url string) (io.ReadCloser, error) {
 	url = strings.Trim(url, "/")
 	fields := strings.Split(url, "/")
 	if len(fields) == 0 {
-		return nil, errors.New(fmt.Sprintf("Invalid dpaste paste URL %v", url))
+		return nil, newError(ErrUsage, "Invalid dpaste paste URL %v", url)
 	}
 	id := fields[len(fields)-1]
 	id = dpPrefix.ReplaceAllLiteralString(id, "")
-	resp, err := http.Get(fmt.Sprintf("http://dpaste.org/%s/raw/", id))
+	resp, err := dph.client.Get(ctx, fmt.Sprintf("http://dpaste.org/%s/raw/", id))
 	if err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
-func (dph *DpasteHandler) WritePaste(r io.Reader) (string, error) {
+func (dph *DpasteHandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
-	resp, err := http.PostForm("http://dpaste.org/",
+	resp, err := dph.client.PostForm(ctx, "http://dpaste.org/",
 		url.Values{
 			"content": {string(contents)},
 			"lexer": {dph.Lexer},
-			"expire_options": {fmt.Sprintf("%d", dph.Expire)},
-			"title": {dph.Title}})
+			"expire_options": {dph.Expire},
+			"title": {dph.Title}},
+		http.StatusOK, http.StatusCreated, http.StatusFound, http.StatusSeeOther)
 	if err != nil {
 		return "", err
 	}
 	url := resp.Header.Get("Location")
 	defer resp.Body.Close()
 	if url == "" {
-		return "", errors.New(fmt.Sprintf("Paste location missing from response header: %v",
-				resp.Header))
+		return "", newError(ErrRejected, "Paste location missing from response header: %v",
+				resp.Header)
 	}
 	fields := strings.Split(strings.TrimRight(url, "/"), "/")
 	id := fields[len(fields)-1]
 	if len(fields) < 2 {
-		return "", errors.New(fmt.Sprintf("Invalid response: %s", id))
+		return "", newError(ErrRejected, "Invalid response: %s", id)
 	}
 	return fmt.Sprintf("%s:%s", dph.Prefix(), id), err
 }
@@ -0,0 +1,128 @@
+package antipaste
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	pgperrors "github.com/cmars/go.crypto/openpgp/errors"
+)
+
+// Returned by get when the paste signature does not verify.
+var ErrBadSignature = errors.New("Bad signature")
+
+// Returned by get when the paste was signed by a key not in our key rings.
+var ErrUnknownSigner = errors.New("Signed by unknown key")
+
+// Kinds of error, which antipaste exits with distinct codes for. Errors
+// are either one of these or carry one as their Kind.
+var (
+	// Bad command line arguments
+	ErrUsage = errors.New("Usage error")
+	// No such paste or key
+	ErrNotFound = errors.New("Not found")
+	// The paste couldn't be decrypted with any key or passphrase we have
+	ErrDecryptFailed = errors.New("Decrypt failed")
+	// A recipient key is unknown, ambiguous or can't be encrypted to
+	ErrUnknownRecipient = errors.New("Unknown recipient")
+	// A paste service refused a request
+	ErrRejected = errors.New("Rejected by paste service")
+	// A paste service asked us to slow down
+	ErrRateLimited = errors.New("Rate limited")
+	// A paste service or keyserver couldn't be reached
+	ErrNetwork = errors.New("Network error")
+	// Cancelled by an interrupt
+	ErrInterrupted = errors.New("Interrupted")
+)
+
+// Exit codes, by kind of error. Any other error exits with 1.
+var exitCodes map[error]int = map[error]int{
+	ErrBadSignature: 2,
+	ErrUnknownSigner: 2,
+	ErrUsage: 3,
+	ErrNotFound: 4,
+	ErrDecryptFailed: 5,
+	ErrBadPassphrase: 5,
+	ErrUnknownRecipient: 6,
+	ErrRejected: 7,
+	ErrRateLimited: 8,
+	ErrNetwork: 9,
+	ErrInterrupted: 130,
+}
+
+// An error of a known kind, with the details.
+type Error struct {
+	kind error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Kind() error {
+	return e.kind
+}
+
+func newError(kind error, format string, args ...interface{}) error {
+	return &Error{ kind: kind, Message: fmt.Sprintf(format, args...) }
+}
+
+// Get the kind of an error, or nil if it isn't of any known kind.
+func ErrorKind(err error) error {
+	if _, has := exitCodes[err]; has {
+		return err
+	}
+	if kinded, is := err.(interface{ Kind() error }); is {
+		return kinded.Kind()
+	}
+	if urlErr, is := err.(*url.Error); is {
+		err = urlErr.Err
+	}
+	switch err.(type) {
+	case pgperrors.StructuralError, pgperrors.UnsupportedError:
+		return ErrDecryptFailed
+	case pgperrors.SignatureError:
+		return ErrBadSignature
+	case net.Error:
+		return ErrNetwork
+	}
+	switch {
+	case err == pgperrors.ErrKeyIncorrect:
+		return ErrDecryptFailed
+	case err == pgperrors.ErrUnknownIssuer:
+		return ErrUnknownSigner
+	case err == context.Canceled:
+		return ErrInterrupted
+	case err == context.DeadlineExceeded:
+		return ErrNetwork
+	case os.IsNotExist(err):
+		return ErrNotFound
+	}
+	return nil
+}
+
+// The code antipaste exits with for an error:
+//
+//	0	success
+//	1	any other error
+//	2	bad signature, or signed by an unknown key
+//	3	bad command line arguments
+//	4	paste or key not found
+//	5	decryption failed, or a bad passphrase
+//	6	unknown or unusable recipient
+//	7	rejected by the paste service
+//	8	rate limited by the paste service
+//	9	network error
+//	130	interrupted
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, has := exitCodes[ErrorKind(err)]; has {
+		return code
+	}
+	return 1
+}
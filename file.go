@@ -0,0 +1,86 @@
+package antipaste
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Keeps pastes as files in a local directory, for sharing over some other
+// channel or for working offline.
+type FileHandler struct {
+	Dir string
+}
+
+func init() {
+	Register("file", NewFileHandler,
+		HandlerOption{ "dir", "", "Directory pastes are written to (default: pastes in homedir)" })
+}
+
+func NewFileHandler(config *HandlerConfig) (ProtocolHandler, error) {
+	dir := config.Get("dir")
+	if dir == "" {
+		basepath, err := homeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(basepath, "pastes")
+	}
+	return &FileHandler{ Dir: dir }, nil
+}
+
+func (fh *FileHandler) Prefix() string {
+	return "file"
+}
+
+func (fh *FileHandler) ReadPaste(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (fh *FileHandler) DeletePaste(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (fh *FileHandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
+	if err := os.MkdirAll(fh.Dir, 0700); err != nil {
+		return "", err
+	}
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(fh.Dir, hex.EncodeToString(id) + ".asc"))
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, &contextReader{ ctx: ctx, r: r }); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", fh.Prefix(), path), nil
+}
+
+// Fails reads once a context is done, so that copying stops.
+type contextReader struct {
+	ctx context.Context
+	r io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -1,70 +1,137 @@
 package antipaste
 
 import (
+	"context"
 	"bytes"
 	"encoding/json"
-	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 )
 
-var gistDesc = flag.String("gist-desc", "", "gist description")
-var gistFilename = flag.String("gist-filename", "README", "gist filename")
 var gistPrefix = regexp.MustCompile("^gist:")
 
+// Environment variable holding a GitHub token, used when the gist handler
+// has none configured.
+const GithubTokenEnv = "GITHUB_TOKEN"
+
 type ghandler struct {
 	Description string
 	Filename string
+	Public bool
+	Token string
+	Api string
+	client *HttpClient
 }
 
 func init() {
-	gh := &ghandler{
-		Description: *gistDesc,
-		Filename: *gistFilename }
-	protocolHandlers[gh.Prefix()] = gh
+	Register("gist", newGistHandler,
+		HandlerOption{ "desc", "", "gist description" },
+		HandlerOption{ "filename", "README", "gist filename" },
+		HandlerOption{ "public", "false", "Post public gists rather than secret ones" },
+		HandlerOption{ "token", "", "GitHub API token (default: $" + GithubTokenEnv + ")" },
+		HandlerOption{ "api", "https://api.github.com", "GitHub API base URL, for GitHub Enterprise" })
+}
+
+func newGistHandler(config *HandlerConfig) (ProtocolHandler, error) {
+	public, err := config.GetBool("public")
+	if err != nil {
+		return nil, err
+	}
+	token := config.Get("token")
+	if token == "" {
+		token = os.Getenv(GithubTokenEnv)
+	}
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return &ghandler{
+		Description: config.Get("desc"),
+		Filename: config.Get("filename"),
+		Public: public,
+		Token: token,
+		Api: strings.TrimRight(config.Get("api"), "/"),
+		client: client }, nil
 }
 
 func (gh *ghandler) Prefix() string {
 	return "gist"
 }
 
-func (gh *ghandler) ReadPaste(url string) (io.ReadCloser, error) {
+// Make a GitHub API request, authenticated if we have a token.
+func (gh *ghandler) request(ctx context.Context, method string, url string, body []byte,
+		expect int) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	if gh.Token != "" {
+		header.Set("Authorization", "token " + gh.Token)
+	}
+	return gh.client.Do(ctx, method, url, header, body, expect)
+}
+
+func gistId(url string) (string, error) {
 	url = strings.Trim(url, "/")
 	fields := strings.Split(url, "/")
-	if len(fields) == 0 {
-		return nil, errors.New(fmt.Sprintf("Invalid gist paste URL %v", url))
+	id := gistPrefix.ReplaceAllLiteralString(fields[len(fields)-1], "")
+	if id == "" {
+		return "", newError(ErrUsage, "Invalid gist paste URL %v", url)
+	}
+	return id, nil
+}
+
+type GistFile struct {
+	Content string `json:"content"`
+	RawUrl string `json:"raw_url"`
+	Truncated bool `json:"truncated"`
+}
+
+type GistMsg struct {
+	Id string `json:"id"`
+	Files map[string]*GistFile `json:"files"`
+}
+
+func (gh *ghandler) ReadPaste(ctx context.Context, url string) (io.ReadCloser, error) {
+	id, err := gistId(url)
+	if err != nil {
+		return nil, err
 	}
-	id := fields[len(fields)-1]
-	id = gistPrefix.ReplaceAllLiteralString(id, "")
-	resp, err := http.Get(fmt.Sprintf("https://api.github.com/gists/%v", id))
+	resp, err := gh.request(ctx, "GET", gh.Api + "/gists/" + id, nil, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	msg := make(map[string]interface{})
-	json.Unmarshal(body, &msg)
-	if files, has := msg["files"]; has {
-		if filesMap, is := files.(map[string]interface{}); is {
-			for _, file := range filesMap {
-				if fileMap, is := file.(map[string]interface{}); is {
-					if content, has := fileMap["content"]; has {
-						if contentStr, is := content.(string); is {
-							return ioutil.NopCloser(bytes.NewBufferString(contentStr)), nil
-						}
-					}
-				}
-			}
+	msg := &GistMsg{}
+	if err = json.Unmarshal(body, msg); err != nil || len(msg.Files) == 0 {
+		return nil, newError(ErrRejected, "Unrecognized response format: %s", string(body))
+	}
+	file, has := msg.Files[gh.Filename]
+	if !has {
+		for _, file = range msg.Files {
+			break
 		}
 	}
-	return nil, errors.New(fmt.Sprintf("Unrecognized response format: %s", string(body)))
+	if !file.Truncated {
+		return ioutil.NopCloser(bytes.NewBufferString(file.Content)), nil
+	}
+	// Large files are cut short in the API, fetch them whole. Secret gists
+	// on GitHub Enterprise may need the token for this too.
+	rawResp, err := gh.request(ctx, "GET", file.RawUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return rawResp.Body, nil
 }
 
 type GistPostFile struct {
@@ -77,35 +144,46 @@ type GistPostMsg struct {
 	Files map[string]*GistPostFile `json:"files"`
 }
 
-func (gh *ghandler) WritePaste(r io.Reader) (string, error) {
+func (gh *ghandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
+	if gh.Token == "" {
+		return "", newError(ErrUsage,
+			"GitHub needs a token to create gists, set -gist-token or $%s", GithubTokenEnv)
+	}
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
 	jsonMsg := &GistPostMsg{
 		Description: gh.Description,
-		Public: true,
+		Public: gh.Public,
 		Files: make(map[string]*GistPostFile) }
 	jsonMsg.Files[gh.Filename] = &GistPostFile{ Content: string(contents) }
 	jsonData, err := json.Marshal(jsonMsg)
 	if err != nil {
 		return "", err
 	}
-	resp, err := http.Post("https://api.github.com/gists", "application/json",
-		bytes.NewBuffer(jsonData))
+	resp, err := gh.request(ctx, "POST", gh.Api + "/gists", jsonData, http.StatusCreated)
 	if err != nil {
 		return "", err
 	}
-	url := resp.Header.Get("Location")
 	defer resp.Body.Close()
-	if url == "" {
-		return "", errors.New(fmt.Sprintf("Paste location missing from response header: %v",
-				resp.Header))
+	msg := &GistMsg{}
+	if err = json.NewDecoder(resp.Body).Decode(msg); err != nil || msg.Id == "" {
+		return "", newError(ErrRejected, "Paste id missing from response: %v", err)
 	}
-	fields := strings.Split(strings.TrimRight(url, "/"), "/")
-	id := fields[len(fields)-1]
-	if len(fields) < 2 {
-		return "", errors.New(fmt.Sprintf("Invalid response: %s", id))
+	return fmt.Sprintf("%s:%s", gh.Prefix(), msg.Id), nil
+}
+
+// Delete a gist. Only its owner's token can do this.
+func (gh *ghandler) DeletePaste(ctx context.Context, url string) error {
+	id, err := gistId(url)
+	if err != nil {
+		return err
+	}
+	resp, err := gh.request(ctx, "DELETE", gh.Api + "/gists/" + id, nil, http.StatusNoContent)
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("%s:%s", gh.Prefix(), id), err
+	resp.Body.Close()
+	return nil
 }
@@ -1,13 +1,214 @@
 package antipaste
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var protocolHandlers map[string]ProtocolHandler = make(map[string]ProtocolHandler)
-
+// Reads and writes pastes on a paste service. Requests are abandoned when
+// their context is done.
 type ProtocolHandler interface {
 	Prefix() string
-	ReadPaste(url string) (io.ReadCloser, error)
-	WritePaste(r io.Reader) (string, error)
+	ReadPaste(ctx context.Context, url string) (io.ReadCloser, error)
+	WritePaste(ctx context.Context, r io.Reader) (string, error)
+}
+
+// Implemented by protocol handlers which can remove pastes.
+type Deleter interface {
+	DeletePaste(ctx context.Context, url string) error
+}
+
+// Implemented by protocol handlers whose pastes can be set to expire. The
+// expiry applies to pastes written afterwards. Returns the expiry actually
+// applied, which may differ from the one asked for. Expiry is the expiry
+// pastes written next get, by default or as set, or 0 if they don't expire.
+type Expirer interface {
+	SetExpiry(ttl time.Duration) (time.Duration, error)
+	Expiry() time.Duration
+}
+
+// Creates a protocol handler from its parsed configuration.
+type HandlerFactory func(config *HandlerConfig) (ProtocolHandler, error)
+
+// An option understood by a protocol handler. Each option can be given on
+// the command line as -<handler>-<name>, in the environment as
+// ANTIPASTE_<HANDLER>_<NAME>, or in the "handlers" section of the config file.
+type HandlerOption struct {
+	Name string
+	Default string
+	Usage string
+}
+
+// Option values for one protocol handler.
+type HandlerConfig struct {
+	Name string
+	values map[string]string
+	// Config file, for handlers which create other handlers
+	file *Config
+}
+
+type handlerRegistration struct {
+	factory HandlerFactory
+	options []HandlerOption
+}
+
+var handlerRegistry map[string]*handlerRegistration = make(map[string]*handlerRegistration)
+
+// Register a protocol handler factory under a URI prefix, along with the
+// options it accepts. Call from init, so that the options are defined
+// before command line flags are parsed.
+func Register(name string, factory HandlerFactory, options ...HandlerOption) {
+	if _, has := handlerRegistry[name]; has {
+		panic(fmt.Sprintf("Protocol handler registered twice: %s", name))
+	}
+	for _, option := range options {
+		flag.String(optionFlag(name, option.Name), option.Default, option.Usage)
+	}
+	handlerRegistry[name] = &handlerRegistration{ factory: factory, options: options }
+}
+
+// Whether a protocol handler is registered under name.
+func HasHandler(name string) bool {
+	_, has := handlerRegistry[name]
+	return has
+}
+
+// Create the protocol handler registered under name, configured from
+// command line flags, the environment, the config file and option defaults,
+// in that order of precedence. Flags must already be parsed.
+func NewHandler(name string, fileConfig *Config) (ProtocolHandler, error) {
+	reg, has := handlerRegistry[name]
+	if !has {
+		return nil, newError(ErrUsage, "Unknown protocol handler: %s", name)
+	}
+	config := &HandlerConfig{ Name: name, values: make(map[string]string), file: fileConfig }
+	for _, option := range reg.options {
+		config.values[option.Name] = option.Default
+		if value, has := fileConfig.handlerOption(name, option.Name); has {
+			config.values[option.Name] = value
+		}
+		if value := os.Getenv(optionEnv(name, option.Name)); value != "" {
+			config.values[option.Name] = value
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		for _, option := range reg.options {
+			if f.Name == optionFlag(name, option.Name) {
+				config.values[option.Name] = f.Value.String()
+			}
+		}
+	})
+	return reg.factory(config)
+}
+
+// Have the pastes written by a handler expire, if it can. Pastes which
+// can't are left for history -prune -remote to delete, with a warning.
+// Returns the expiry applied, or when the paste is due to be deleted.
+func setExpiry(handler ProtocolHandler, ttl time.Duration) (time.Duration, error) {
+	expirer, ok := handler.(Expirer)
+	if !ok {
+		if _, ok = handler.(Deleter); ok {
+			fmt.Fprintf(os.Stderr,
+				"Warning: %s pastes don't expire, delete them with antipaste history -prune -remote\n",
+				handler.Prefix())
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: %s pastes can neither expire nor be deleted\n", handler.Prefix())
+		}
+		return ttl, nil
+	}
+	return expirer.SetExpiry(ttl)
+}
+
+// The expiry pastes written by a handler get, or 0 if they don't expire.
+func handlerExpiry(handler ProtocolHandler) time.Duration {
+	if expirer, ok := handler.(Expirer); ok {
+		return expirer.Expiry()
+	}
+	return 0
+}
+
+// Delete the paste at a URI, if its protocol handler can.
+func deletePaste(ctx context.Context, uri string, fileConfig *Config) error {
+	protocol, target, err := parseUri(uri)
+	if err != nil {
+		return err
+	}
+	handler, err := NewHandler(protocol, fileConfig)
+	if err != nil {
+		return err
+	}
+	deleter, ok := handler.(Deleter)
+	if !ok {
+		return newError(ErrUsage, "%s pastes can't be deleted", protocol)
+	}
+	return deleter.DeletePaste(ctx, target)
+}
+
+// Delete an expired paste where it was posted. Pastes already gone, and
+// those whose protocol expires them on its own, count as deleted. Those
+// which can't be deleted at all are left in place with a warning.
+func deleteExpired(ctx context.Context, uri string, fileConfig *Config) error {
+	protocol, target, err := parseUri(uri)
+	if err != nil {
+		return err
+	}
+	handler, err := NewHandler(protocol, fileConfig)
+	if err != nil {
+		return err
+	}
+	if multi, ok := handler.(*MultiHandler); ok {
+		return multi.deleteMembers(ctx, target, deleteExpired)
+	}
+	if _, ok := handler.(Expirer); ok {
+		return nil
+	}
+	deleter, ok := handler.(Deleter)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Warning: %s pastes can't be deleted, %s is left in place\n", protocol, uri)
+		return nil
+	}
+	if err = deleter.DeletePaste(ctx, target); ErrorKind(err) == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func optionFlag(handler string, option string) string {
+	return fmt.Sprintf("%s-%s", handler, option)
+}
+
+func optionEnv(handler string, option string) string {
+	name := fmt.Sprintf("ANTIPASTE_%s_%s", handler, option)
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Get the value of an option.
+func (config *HandlerConfig) Get(option string) string {
+	return config.values[option]
+}
+
+// Get the value of an integer option.
+func (config *HandlerConfig) GetInt(option string) (int, error) {
+	value, err := strconv.ParseInt(config.values[option], 10, 32)
+	if err != nil {
+		return 0, newError(ErrUsage, "Invalid %s %s: %s",
+			config.Name, option, config.values[option])
+	}
+	return int(value), nil
+}
+
+// Get the value of a boolean option.
+func (config *HandlerConfig) GetBool(option string) (bool, error) {
+	value, err := strconv.ParseBool(config.values[option])
+	if err != nil {
+		return false, newError(ErrUsage, "Invalid %s %s: %s",
+			config.Name, option, config.values[option])
+	}
+	return value, nil
 }
@@ -0,0 +1,191 @@
+package antipaste
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A paste we made, as recorded in the history file.
+type HistoryEntry struct {
+	Uri string `json:"uri"`
+	// URIs of the chunks of a paste posted with -chunk-size, whose URI is
+	// that of the manifest listing them
+	Chunks []string `json:"chunks,omitempty"`
+	Protocol string `json:"protocol"`
+	// Fingerprints of the recipient keys, none for -symmetric and -link pastes
+	Recipients []string `json:"recipients,omitempty"`
+	// Whether the URI needs a -link key, which is not recorded
+	Link bool `json:"link,omitempty"`
+	Files []string `json:"files"`
+	// Bytes of ciphertext posted
+	Size int64 `json:"size"`
+	Created time.Time `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func historyFile() (string, error) {
+	basepath, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(basepath, "history.json"), nil
+}
+
+// Load the paste history. A missing file is an empty history.
+func LoadHistory() ([]*HistoryEntry, error) {
+	path, err := historyFile()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*HistoryEntry{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid history file %s: %v", path, err))
+	}
+	return entries, nil
+}
+
+// Write the paste history, replacing the file whole.
+func SaveHistory(entries []*HistoryEntry) error {
+	path, err := historyFile()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Add a paste to the history.
+func recordHistory(entry *HistoryEntry) error {
+	entries, err := LoadHistory()
+	if err != nil {
+		return err
+	}
+	return SaveHistory(append(entries, entry))
+}
+
+// The history entry of a paste, or nil if it isn't in the history.
+func findHistory(uri string) (*HistoryEntry, error) {
+	entries, err := LoadHistory()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Uri == uri {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// Remove a deleted paste from the history.
+func forgetHistory(uri string) error {
+	entries, err := LoadHistory()
+	if err != nil {
+		return err
+	}
+	kept := []*HistoryEntry{}
+	for _, entry := range entries {
+		if entry.Uri != uri {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return SaveHistory(kept)
+}
+
+// Whether a paste has expired.
+func (entry *HistoryEntry) expired(now time.Time) bool {
+	return entry.Expires != nil && now.After(*entry.Expires)
+}
+
+// Whether a history entry matches a search term: part of its URI,
+// protocol or a file name, or a recipient's fingerprint suffix, name
+// or email.
+func (pgp *Pgp) historyMatches(entry *HistoryEntry, term string) bool {
+	term = strings.ToLower(term)
+	if strings.Contains(strings.ToLower(entry.Uri), term) || entry.Protocol == term {
+		return true
+	}
+	for _, file := range entry.Files {
+		if strings.Contains(strings.ToLower(file), term) {
+			return true
+		}
+	}
+	for _, fingerprint := range entry.Recipients {
+		if strings.HasSuffix(fingerprint, term) {
+			return true
+		}
+		if entity := findEntity(pgp.PubRing, fingerprint); entity != nil && uidMatches(entity, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// Print a history entry in a listing.
+func (pgp *Pgp) listHistoryEntry(w io.Writer, entry *HistoryEntry, now time.Time) {
+	expires := "never"
+	if entry.Expires != nil {
+		expires = entry.Expires.Format("2006-01-02 15:04")
+		if entry.expired(now) {
+			expires += " (expired)"
+		}
+	}
+	fmt.Fprintf(w, "paste %s\n", entry.Uri)
+	fmt.Fprintf(w, "      created %s expires %s, %d bytes\n",
+		entry.Created.Format("2006-01-02 15:04"), expires, entry.Size)
+	if len(entry.Files) > 0 {
+		fmt.Fprintf(w, "file  %s\n", strings.Join(entry.Files, " "))
+	}
+	switch {
+	case entry.Link:
+		fmt.Fprintf(w, "to    anyone with the -link key\n")
+	case len(entry.Recipients) == 0:
+		fmt.Fprintf(w, "to    anyone with the passphrase\n")
+	}
+	for _, fingerprint := range entry.Recipients {
+		uid := ""
+		if entity := findEntity(pgp.PubRing, fingerprint); entity != nil {
+			uid = primaryUid(entity)
+		}
+		fmt.Fprintf(w, "to    %s %s\n", fingerprint, uid)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
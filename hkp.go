@@ -1,11 +1,12 @@
 package antipaste
 
 import (
+	"context"
 	"bufio"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"github.com/cmars/go.crypto/openpgp"
@@ -43,9 +44,9 @@ func NewHkp(hostname string, port int) *Hkp {
 func ParseHkpUri(uri string) (*Hkp, error) {
 	hkpFields := strings.Split(uri, ":")
 	if len(hkpFields) < 1 {
-		return nil, errors.New(fmt.Sprintf("Invalid Hkp Uri: %s", uri))
+		return nil, newError(ErrUsage, "Invalid Hkp Uri: %s", uri)
 	}
-	hkp := &Hkp{ Hostname: hkpFields[0] }
+	hkp := NewHkp(hkpFields[0], 0)
 	if len(hkpFields) > 1 {
 		hkpPort, err := strconv.ParseUint(hkpFields[1], 10, 32)
 		if err != nil {
@@ -60,10 +61,14 @@ func (hkp *Hkp) BaseUrl() string {
 	return fmt.Sprintf("http://%s:%d", hkp.Hostname, hkp.Port)
 }
 
-func (hkp *Hkp) Lookup(value string) (results []*HkpResult, err error) {
-	resp, err := http.Get(fmt.Sprintf(
+func (hkp *Hkp) Lookup(ctx context.Context, value string) (results []*HkpResult, err error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, fmt.Sprintf(
 			"%s/pks/lookup?op=index&search=%s&options=mr",
-			hkp.BaseUrl(), value))
+			hkp.BaseUrl(), url.QueryEscape(value)))
 	if err != nil {
 		return nil, err
 	}
@@ -141,9 +146,17 @@ func (hkp *Hkp) Lookup(value string) (results []*HkpResult, err error) {
 	return results, err
 }
 
-func (hkp *Hkp) Get(keyid string) (*openpgp.Entity, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/pks/lookup?op=get&search=0x%s",
-			hkp.BaseUrl(), keyid))
+func (hkp *Hkp) Get(ctx context.Context, keyid string) (*openpgp.Entity, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, fmt.Sprintf("%s/pks/lookup?op=get&search=0x%s",
+			hkp.BaseUrl(), url.QueryEscape(keyid)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 	entities, err := openpgp.ReadArmoredKeyRing(resp.Body)
 	if err != nil {
 		return nil, err
@@ -151,5 +164,5 @@ func (hkp *Hkp) Get(keyid string) (*openpgp.Entity, error) {
 	for _, entity := range entities {
 		return entity, nil
 	}
-	return nil, errors.New("Key not found")
+	return nil, newError(ErrNotFound, "Key not found")
 }
@@ -0,0 +1,162 @@
+package antipaste
+
+import (
+	"context"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"github.com/cmars/go.crypto/openpgp/armor"
+)
+
+// Tags which break lines in HTML, and all the others.
+var htmlBreakRE = regexp.MustCompile(`(?i)<br\s*/?>|</?(p|div|pre|li|tr)(\s[^>]*)?>`)
+var htmlTagRE = regexp.MustCompile(`<[^>]*>`)
+
+// An armor header line, such as Version: or Comment:.
+var armorHeaderRE = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// Reads pastes from any web page holding an ASCII-armored block, such as
+// a wiki page, forum post or issue comment. Pastes can be uploaded to an
+// endpoint taking the paste as the request body, such as a WebDAV share
+// or a pastebin with a plain HTTP API.
+type HttpHandler struct {
+	Scheme string
+	// Where pastes are uploaded to, with {id} replaced by a random ID
+	Url string
+	// PUT or POST
+	Method string
+	client *HttpClient
+}
+
+func init() {
+	for _, scheme := range []string{ "http", "https" } {
+		Register(scheme, NewHttpHandler,
+			HandlerOption{ "url", "", "Endpoint put uploads pastes to, {id} is replaced by a random ID" },
+			HandlerOption{ "method", "PUT", "HTTP method put uploads pastes with, PUT or POST" })
+	}
+}
+
+func NewHttpHandler(config *HandlerConfig) (ProtocolHandler, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(config.Get("method"))
+	if method != "PUT" && method != "POST" {
+		return nil, newError(ErrUsage, "Invalid %s method: %s", config.Name, config.Get("method"))
+	}
+	uploadUrl := config.Get("url")
+	if uploadUrl != "" && !strings.HasPrefix(uploadUrl, config.Name + "://") {
+		return nil, newError(ErrUsage, "Invalid %s url: %s", config.Name, uploadUrl)
+	}
+	return &HttpHandler{ Scheme: config.Name, Url: uploadUrl, Method: method, client: client }, nil
+}
+
+func (hh *HttpHandler) Prefix() string {
+	return hh.Scheme
+}
+
+func (hh *HttpHandler) ReadPaste(ctx context.Context, url string) (io.ReadCloser, error) {
+	resp, err := hh.client.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, err := findArmor(contents)
+	if err != nil {
+		return nil, newError(ErrNotFound, "%v in %s", err, url)
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(block)), nil
+}
+
+// Upload a paste as the request body, streamed as it is encrypted. The
+// paste is at the Location of the response if it has one, else the URL
+// that makes up the whole response body, else the URL uploaded to.
+func (hh *HttpHandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
+	if hh.Url == "" {
+		return "", newError(ErrUsage, "No URL to upload %s pastes to, set one with -%s",
+			hh.Scheme, optionFlag(hh.Scheme, "url"))
+	}
+	target := hh.Url
+	if strings.Contains(target, "{id}") {
+		id := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return "", err
+		}
+		target = strings.Replace(target, "{id}", hex.EncodeToString(id), -1)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	resp, err := hh.client.Stream(ctx, hh.Method, target, header, r,
+		http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if location, err := resp.Location(); err == nil {
+		return location.String(), nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	if pasteUrl, err := url.Parse(strings.TrimSpace(string(body))); err == nil && pasteUrl.Host != "" &&
+			(pasteUrl.Scheme == "http" || pasteUrl.Scheme == "https") {
+		return pasteUrl.String(), nil
+	}
+	return target, nil
+}
+
+// Find the first ASCII-armored block in a page that decodes, undoing any
+// HTML markup and entities around and within it.
+func findArmor(contents []byte) ([]byte, error) {
+	text := htmlBreakRE.ReplaceAllLiteralString(string(contents), "\n")
+	text = html.UnescapeString(htmlTagRE.ReplaceAllLiteralString(text, ""))
+	for _, match := range pgpBlockRE.FindAllString(text, -1) {
+		block := []byte(strings.Join(armorLines(match), "\n") + "\n")
+		if decoded, err := armor.Decode(bytes.NewBuffer(block)); err == nil {
+			if _, err = io.Copy(ioutil.Discard, decoded.Body); err == nil {
+				return block, nil
+			}
+		}
+	}
+	return nil, newError(ErrNotFound, "No ASCII-armored block found")
+}
+
+// Rebuild the lines of an armored block from a page, which may have lost
+// or gained line breaks and indentation: the BEGIN line, any headers, a
+// blank line, then the rest with blank lines dropped.
+func armorLines(match string) []string {
+	result := []string{}
+	inHeaders := false
+	for _, line := range strings.Split(match, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case len(result) == 0:
+			result = append(result, line)
+			inHeaders = true
+		case inHeaders && armorHeaderRE.MatchString(line):
+			result = append(result, line)
+		case line == "":
+			;
+		default:
+			if inHeaders {
+				result = append(result, "")
+				inHeaders = false
+			}
+			result = append(result, line)
+		}
+	}
+	return result
+}
@@ -0,0 +1,249 @@
+package antipaste
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var httpTimeout = flag.Duration("http-timeout", 60 * time.Second, "Time limit for each request to a paste service or keyserver, or for the response to a streamed upload")
+var httpProxy = flag.String("http-proxy", "", "Proxy URL for paste services and keyservers (default: $HTTPS_PROXY or $HTTP_PROXY)")
+var httpRetries = flag.Int("http-retries", 3, "Times to retry requests which fail with a server error or are rate limited")
+
+// Sent with every request.
+const UserAgent = "antipaste"
+
+// Wait before the first retry, doubled each time after.
+const retryBackoff = time.Second
+
+// Longest we honour a Retry-After response header for.
+const maxRetryAfter = time.Minute
+
+// Returned when a server answers with an unexpected status.
+type StatusError struct {
+	Method string
+	Url string
+	StatusCode int
+	Status string
+	// Start of the response body, which often says what went wrong
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.Url, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.Url, e.Status, e.Body)
+}
+
+// The kind of error a status is.
+func (e *StatusError) Kind() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone:
+		return ErrNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return ErrRejected
+}
+
+// Whether a request failing with this status is worth trying again.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// HTTP client shared by protocol handlers and keyservers, with time limits,
+// proxy settings, status checks and retries.
+type HttpClient struct {
+	client *http.Client
+	// Without an overall time limit, which a long upload would run into
+	streamClient *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+var sharedClient *HttpClient
+var sharedClientOnce sync.Once
+var sharedClientErr error
+
+// Get the HTTP client configured by command line flags. Flags must already
+// be parsed.
+func httpClient() (*HttpClient, error) {
+	sharedClientOnce.Do(func() {
+		sharedClient, sharedClientErr = NewHttpClient(*httpTimeout, *httpProxy, *httpRetries)
+	})
+	return sharedClient, sharedClientErr
+}
+
+// Create an HTTP client. Requests other than GET do not follow redirects,
+// as some paste services answer a post with a redirect to the new paste.
+func NewHttpClient(timeout time.Duration, proxy string, retries int) (*HttpClient, error) {
+	transport := &http.Transport{ Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: timeout }
+	if proxy != "" {
+		proxyUrl, err := url.Parse(proxy)
+		if err != nil {
+			return nil, newError(ErrUsage, "Invalid proxy %s: %v", proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		if via[0].Method != "GET" {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("Too many redirects")
+		}
+		return nil
+	}
+	return &HttpClient{
+		client: &http.Client{ Transport: transport, Timeout: timeout, CheckRedirect: checkRedirect },
+		streamClient: &http.Client{ Transport: transport, CheckRedirect: checkRedirect },
+		Retries: retries,
+		Backoff: retryBackoff }, nil
+}
+
+// Send a request, retrying with backoff when it is rate limited, fails
+// with a server error or doesn't get through at all. Requests other than
+// GET may already have had their effect, such as posting a paste, so they
+// are only retried when rate limited, unavailable or never sent. A
+// response with any status but the expected ones, 200 OK if none are
+// given, is closed and returned as a *StatusError.
+func (hc *HttpClient) Do(ctx context.Context, method string, reqUrl string, header http.Header,
+		body []byte, expect ...int) (*http.Response, error) {
+	if len(expect) == 0 {
+		expect = []int{ http.StatusOK }
+	}
+	backoff := hc.Backoff
+	for attempt := 0; ; attempt++ {
+		var bodyIn io.Reader
+		if body != nil {
+			bodyIn = bytes.NewBuffer(body)
+		}
+		resp, err := hc.do(ctx, hc.client, method, reqUrl, header, bodyIn, expect)
+		if err == nil {
+			return resp, nil
+		} else if attempt >= hc.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		if !retryable(method, err) {
+			return nil, err
+		}
+		wait := backoff
+		if retryAfter, has := retryAfterDelay(resp); has {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// Whether a request that failed with err is worth sending again.
+func retryable(method string, err error) bool {
+	if statusErr, is := err.(*StatusError); is {
+		if method == "GET" {
+			return statusErr.Temporary()
+		}
+		return statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return method == "GET" || notSent(err)
+}
+
+// Whether a request that failed with err certainly never reached the
+// server: the connection to it, or to the proxy, couldn't be made.
+func notSent(err error) bool {
+	if urlErr, is := err.(*url.Error); is {
+		err = urlErr.Err
+	}
+	opErr, is := err.(*net.OpError)
+	return is && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// Send a request with a body that is read as it is sent, so that it can't
+// be retried. Statuses are checked as by Do.
+func (hc *HttpClient) Stream(ctx context.Context, method string, reqUrl string, header http.Header,
+		body io.Reader, expect ...int) (*http.Response, error) {
+	if len(expect) == 0 {
+		expect = []int{ http.StatusOK }
+	}
+	resp, err := hc.do(ctx, hc.streamClient, method, reqUrl, header, body, expect)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Send a request once. On a status error the response is returned too, for
+// its headers, with the body closed.
+func (hc *HttpClient) do(ctx context.Context, client *http.Client, method string, reqUrl string,
+		header http.Header, body io.Reader, expect []int) (*http.Response, error) {
+	req, err := http.NewRequest(method, reqUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expect {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	start, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp, &StatusError{
+		Method: method,
+		Url: reqUrl,
+		StatusCode: resp.StatusCode,
+		Status: resp.Status,
+		Body: strings.TrimSpace(string(start)) }
+}
+
+// The delay asked for by a Retry-After header in seconds, if any.
+func retryAfterDelay(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	var seconds int
+	if _, err := fmt.Sscanf(resp.Header.Get("Retry-After"), "%d", &seconds); err != nil || seconds < 0 {
+		return 0, false
+	}
+	delay := time.Duration(seconds) * time.Second
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// Fetch a URL, expecting 200 OK.
+func (hc *HttpClient) Get(ctx context.Context, reqUrl string) (*http.Response, error) {
+	return hc.Do(ctx, "GET", reqUrl, nil, nil)
+}
+
+// Post a form, expecting one of the given statuses, or 200 OK.
+func (hc *HttpClient) PostForm(ctx context.Context, reqUrl string, values url.Values,
+		expect ...int) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return hc.Do(ctx, "POST", reqUrl, header, []byte(values.Encode()), expect...)
+}
@@ -0,0 +1,328 @@
+package antipaste
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"github.com/cmars/go.crypto/openpgp"
+	"github.com/cmars/go.crypto/openpgp/armor"
+	"github.com/cmars/go.crypto/openpgp/packet"
+)
+
+// Import keys from binary or ASCII-armored key data. Keys with private
+// key material go in both key rings, replacing any existing copies.
+func (pgp *Pgp) Import(data []byte) ([]*openpgp.Entity, error) {
+	if block, err := armor.Decode(bytes.NewBuffer(data)); err == nil {
+		if data, err = ioutil.ReadAll(block.Body); err != nil {
+			return nil, err
+		}
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	secPackets, err := splitSecRing(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		pgp.PubRing = replaceEntity(pgp.PubRing, entity)
+		if entity.PrivateKey != nil {
+			pgp.SecRing = replaceEntity(pgp.SecRing, entity)
+			pgp.secPackets[fingerprint] = secPackets[fingerprint]
+		}
+	}
+	return entities, nil
+}
+
+// Remove a key from the public key ring, and from the secret key ring too
+// if secret is set. Removing a public key that has a secret key is refused.
+func (pgp *Pgp) Delete(entity *openpgp.Entity, secret bool) error {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	if findEntity(pgp.SecRing, fingerprint) != nil {
+		if !secret {
+			return newError(ErrUsage,
+				"Secret key present for %s, use key delete -secret to remove both", fingerprint)
+		}
+		pgp.SecRing = removeEntity(pgp.SecRing, fingerprint)
+		delete(pgp.secPackets, fingerprint)
+		delete(pgp.passphrases, fingerprint)
+	}
+	pgp.PubRing = removeEntity(pgp.PubRing, fingerprint)
+	delete(pgp.trusted, fingerprint)
+	return nil
+}
+
+func trustFile() (string, error) {
+	basepath, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(basepath, "trust.json"), nil
+}
+
+// Load the fingerprints of the keys marked as trusted. A missing file
+// trusts no keys.
+func loadTrust() (map[string]bool, error) {
+	trusted := make(map[string]bool)
+	path, err := trustFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return trusted, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fingerprints := []string{}
+	if err = json.Unmarshal(data, &fingerprints); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid trust file %s: %v", path, err))
+	}
+	for _, fingerprint := range fingerprints {
+		trusted[fingerprint] = true
+	}
+	return trusted, nil
+}
+
+// Write the fingerprints of the keys marked as trusted.
+func (pgp *Pgp) saveTrust() error {
+	path, err := trustFile()
+	if err != nil {
+		return err
+	}
+	fingerprints := []string{}
+	for fingerprint, _ := range pgp.trusted {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	data, err := json.MarshalIndent(fingerprints, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Mark a public key as trusted to speak for its user IDs, or remove the
+// mark. Our own secret keys are always trusted.
+func (pgp *Pgp) SetTrust(entity *openpgp.Entity, trusted bool) {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	if trusted {
+		pgp.trusted[fingerprint] = true
+	} else {
+		delete(pgp.trusted, fingerprint)
+	}
+}
+
+// Whether a key is trusted: marked so with key trust, or one of ours.
+func (pgp *Pgp) isTrusted(entity *openpgp.Entity) bool {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	return pgp.trusted[fingerprint] || findEntity(pgp.SecRing, fingerprint) != nil
+}
+
+// Write the public part of a key, ASCII-armored.
+func (pgp *Pgp) Export(w io.Writer, entity *openpgp.Entity) error {
+	armorOut, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err = entity.Serialize(armorOut); err != nil {
+		return err
+	}
+	if err = armorOut.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n")
+	return err
+}
+
+func findEntity(keyring openpgp.EntityList, fingerprint string) *openpgp.Entity {
+	for _, entity := range keyring {
+		fp, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		if fp == fingerprint {
+			return entity
+		}
+	}
+	return nil
+}
+
+func removeEntity(keyring openpgp.EntityList, fingerprint string) openpgp.EntityList {
+	result := openpgp.EntityList{}
+	for _, entity := range keyring {
+		fp, _ := FpToString(entity.PrimaryKey.Fingerprint)
+		if fp != fingerprint {
+			result = append(result, entity)
+		}
+	}
+	return result
+}
+
+func replaceEntity(keyring openpgp.EntityList, entity *openpgp.Entity) openpgp.EntityList {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	return append(removeEntity(keyring, fingerprint), entity)
+}
+
+// Print a key in a listing: fingerprint, validity period, trust, user IDs
+// and subkeys with their capabilities.
+func listEntity(w io.Writer, entity *openpgp.Entity, secret bool, trusted bool) {
+	kind, subKind := "pub", "sub"
+	if secret {
+		kind, subKind = "sec", "ssb"
+	}
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	var selfSig *packet.Signature
+	if ident, has := entity.Identities[primaryUid(entity)]; has {
+		selfSig = ident.SelfSignature
+	}
+	uids := []string{}
+	for name, _ := range entity.Identities {
+		uids = append(uids, name)
+	}
+	sort.Strings(uids)
+	fmt.Fprintf(w, "%s   %s %s [%s]\n", kind, fingerprint,
+		keyValidity(entity.PrimaryKey.CreationTime, selfSig), capabilities(selfSig))
+	if trusted {
+		fmt.Fprintf(w, "      trusted\n")
+	}
+	for _, uid := range uids {
+		fmt.Fprintf(w, "uid   %s\n", uid)
+	}
+	for _, subkey := range entity.Subkeys {
+		fmt.Fprintf(w, "%s   %016X %s [%s]\n", subKind, subkey.PublicKey.KeyId,
+			keyValidity(subkey.PublicKey.CreationTime, subkey.Sig), capabilities(subkey.Sig))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Describe when a key was created and when it expires.
+func keyValidity(created time.Time, sig *packet.Signature) string {
+	expires := "never"
+	if expiry, has := keyExpiry(created, sig); has {
+		expires = expiry.Format("2006-01-02")
+	}
+	return fmt.Sprintf("created %s expires %s", created.Format("2006-01-02"), expires)
+}
+
+// When a key expires according to its self or binding signature, if ever.
+func keyExpiry(created time.Time, sig *packet.Signature) (time.Time, bool) {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}, false
+	}
+	return created.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second), true
+}
+
+// How long before it expires a recipient key draws a warning.
+const expiryWarning = 30 * 24 * time.Hour
+
+// Check that a recipient key can be encrypted to: it must not be revoked
+// or expired, and must have a current encryption-capable key. Returns why
+// it can't, or else a warning if it is about to expire.
+func checkRecipient(entity *openpgp.Entity, now time.Time) (problem string, warning string) {
+	if len(entity.Revocations) > 0 {
+		return "key is revoked", ""
+	}
+	ident, has := entity.Identities[primaryUid(entity)]
+	if !has || ident.SelfSignature == nil {
+		return "key has no self-signed user ID", ""
+	}
+	selfSig := ident.SelfSignature
+	expiry, expires := keyExpiry(entity.PrimaryKey.CreationTime, selfSig)
+	if expires && now.After(expiry) {
+		return fmt.Sprintf("key expired on %s", expiry.Format("2006-01-02")), ""
+	}
+	// Find the encryption key that expires last
+	usable := false
+	usableForever := false
+	var usableUntil time.Time
+	problem = "key has no encryption subkey"
+	for _, subkey := range entity.Subkeys {
+		sig := subkey.Sig
+		if sig == nil || !subkey.PublicKey.PubKeyAlgo.CanEncrypt() {
+			continue
+		}
+		if sig.SigType == packet.SigTypeSubkeyRevocation {
+			problem = "encryption subkey is revoked"
+			continue
+		}
+		if !sig.FlagsValid || !(sig.FlagEncryptCommunications || sig.FlagEncryptStorage) {
+			continue
+		}
+		subExpiry, subExpires := keyExpiry(subkey.PublicKey.CreationTime, sig)
+		if subExpires && now.After(subExpiry) {
+			problem = fmt.Sprintf("encryption subkey expired on %s", subExpiry.Format("2006-01-02"))
+			continue
+		}
+		usable = true
+		if !subExpires {
+			usableForever = true
+		} else if subExpiry.After(usableUntil) {
+			usableUntil = subExpiry
+		}
+	}
+	if !usable && entity.PrimaryKey.PubKeyAlgo.CanEncrypt() &&
+			(!selfSig.FlagsValid || selfSig.FlagEncryptCommunications) {
+		usable, usableForever = true, true
+	}
+	if !usable {
+		return problem, ""
+	}
+	if !usableForever && (!expires || usableUntil.Before(expiry)) {
+		expiry, expires = usableUntil, true
+	}
+	if expires && expiry.Sub(now) < expiryWarning {
+		warning = fmt.Sprintf("key expires on %s", expiry.Format("2006-01-02"))
+	}
+	return "", warning
+}
+
+// The key to encrypt to for a recipient: the newest current encryption
+// subkey, or else the primary key if it may be used for encryption.
+func encryptionKey(entity *openpgp.Entity, now time.Time) *packet.PublicKey {
+	var result *packet.PublicKey
+	var newest time.Time
+	for _, subkey := range entity.Subkeys {
+		sig := subkey.Sig
+		if sig == nil || !subkey.PublicKey.PubKeyAlgo.CanEncrypt() || !sig.FlagsValid ||
+				!(sig.FlagEncryptCommunications || sig.FlagEncryptStorage) || sig.KeyExpired(now) {
+			continue
+		}
+		if result == nil || sig.CreationTime.After(newest) {
+			result, newest = subkey.PublicKey, sig.CreationTime
+		}
+	}
+	if result != nil {
+		return result
+	}
+	ident, has := entity.Identities[primaryUid(entity)]
+	if has && ident.SelfSignature != nil && entity.PrimaryKey.PubKeyAlgo.CanEncrypt() &&
+			(!ident.SelfSignature.FlagsValid || ident.SelfSignature.FlagEncryptCommunications) {
+		return entity.PrimaryKey
+	}
+	return nil
+}
+
+// Key usage flags from a binding signature: Sign, Certify, Encrypt.
+func capabilities(sig *packet.Signature) string {
+	if sig == nil || !sig.FlagsValid {
+		return ""
+	}
+	result := ""
+	if sig.FlagSign {
+		result += "S"
+	}
+	if sig.FlagCertify {
+		result += "C"
+	}
+	if sig.FlagEncryptCommunications || sig.FlagEncryptStorage {
+		result += "E"
+	}
+	return result
+}
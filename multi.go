@@ -0,0 +1,201 @@
+package antipaste
+
+import (
+	"context"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/cmars/go.crypto/openpgp/armor"
+)
+
+// Separates the member URIs of a multi: URI.
+const multiSeparator = "|"
+
+// Posts the same paste to several destinations, so that it can still be
+// read if some of them go away. Its URIs look like multi:dpaste:x|gist:y.
+type MultiHandler struct {
+	Handlers []ProtocolHandler
+	fileConfig *Config
+}
+
+func init() {
+	Register("multi", func(config *HandlerConfig) (ProtocolHandler, error) {
+		return &MultiHandler{ fileConfig: config.file }, nil
+	})
+}
+
+// Create a handler posting to each of the named protocol handlers.
+func NewMultiHandler(names []string, fileConfig *Config) (*MultiHandler, error) {
+	mh := &MultiHandler{ fileConfig: fileConfig }
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "multi" {
+			return nil, newError(ErrUsage, "multi can't be a destination of multi")
+		}
+		handler, err := NewHandler(name, fileConfig)
+		if err != nil {
+			return nil, err
+		}
+		mh.Handlers = append(mh.Handlers, handler)
+	}
+	if len(mh.Handlers) == 0 {
+		return nil, newError(ErrUsage, "No destinations to paste to")
+	}
+	return mh, nil
+}
+
+func (mh *MultiHandler) Prefix() string {
+	return "multi"
+}
+
+// The URIs of each copy of a paste.
+func (mh *MultiHandler) Members(url string) []string {
+	result := []string{}
+	for _, uri := range strings.Split(strings.TrimPrefix(url, "multi:"), multiSeparator) {
+		if uri != "" {
+			result = append(result, uri)
+		}
+	}
+	return result
+}
+
+// Read the first copy of a paste that can be fetched and holds valid
+// ASCII armor.
+func (mh *MultiHandler) ReadPaste(ctx context.Context, url string) (io.ReadCloser, error) {
+	for _, uri := range mh.Members(url) {
+		data, err := mh.readMember(ctx, uri)
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+		}
+		fmt.Fprintf(os.Stderr, "Reading %s failed: %v\n", uri, err)
+	}
+	return nil, newError(ErrNotFound, "No copy of the paste could be read")
+}
+
+func (mh *MultiHandler) readMember(ctx context.Context, uri string) ([]byte, error) {
+	protocol, target, err := parseUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := NewHandler(protocol, mh.fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	r, err := handler.ReadPaste(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Reading the armored body to the end checks its CRC
+	block, err := armor.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(ioutil.Discard, block.Body); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Set the expiry of each destination that supports it, warning about the
+// others. Returns the latest expiry of any copy.
+func (mh *MultiHandler) SetExpiry(ttl time.Duration) (time.Duration, error) {
+	var latest time.Duration
+	for _, handler := range mh.Handlers {
+		applied, err := setExpiry(handler, ttl)
+		if err != nil {
+			return 0, err
+		}
+		if applied > latest {
+			latest = applied
+		}
+	}
+	return latest, nil
+}
+
+// The latest expiry of any copy, or 0 if any copy doesn't expire.
+func (mh *MultiHandler) Expiry() time.Duration {
+	var latest time.Duration
+	for _, handler := range mh.Handlers {
+		expiry := handlerExpiry(handler)
+		if expiry == 0 {
+			return 0
+		}
+		if expiry > latest {
+			latest = expiry
+		}
+	}
+	return latest
+}
+
+// Delete every copy of a paste that can be, failing if any can't.
+func (mh *MultiHandler) DeletePaste(ctx context.Context, url string) error {
+	return mh.deleteMembers(ctx, url, deletePaste)
+}
+
+// Delete each copy of a paste with deleteUri, failing with the kind of the
+// last failure if any copy isn't deleted.
+func (mh *MultiHandler) deleteMembers(ctx context.Context, url string,
+		deleteUri func(context.Context, string, *Config) error) error {
+	failed := 0
+	var lastErr error
+	for _, uri := range mh.Members(url) {
+		if err := deleteUri(ctx, uri, mh.fileConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Deleting %s failed: %v\n", uri, err)
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		kind := ErrorKind(lastErr)
+		if kind == nil {
+			kind = ErrRejected
+		}
+		return newError(kind, "%d copies of the paste were not deleted", failed)
+	}
+	return nil
+}
+
+// Post the paste to all destinations at once. Succeeds if any of them do,
+// with a URI listing the copies that were posted.
+func (mh *MultiHandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	uris := make([]string, len(mh.Handlers))
+	errs := make([]error, len(mh.Handlers))
+	var wg sync.WaitGroup
+	for i, handler := range mh.Handlers {
+		wg.Add(1)
+		go func(i int, handler ProtocolHandler) {
+			defer wg.Done()
+			uris[i], errs[i] = handler.WritePaste(ctx, bytes.NewBuffer(contents))
+		}(i, handler)
+	}
+	wg.Wait()
+	posted := []string{}
+	for i, handler := range mh.Handlers {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "Paste to %s failed: %v\n", handler.Prefix(), errs[i])
+		} else if strings.Contains(uris[i], multiSeparator) {
+			fmt.Fprintf(os.Stderr, "Paste to %s failed: URI %s contains %s\n",
+				handler.Prefix(), uris[i], multiSeparator)
+		} else {
+			posted = append(posted, uris[i])
+		}
+	}
+	if len(posted) == 0 {
+		return "", newError(ErrRejected, "Paste failed at every destination")
+	}
+	return fmt.Sprintf("%s:%s", mh.Prefix(), strings.Join(posted, multiSeparator)), nil
+}
@@ -0,0 +1,248 @@
+package antipaste
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"github.com/cmars/go.crypto/openpgp"
+)
+
+var jsonOutput = flag.Bool("json", false, "Print results and errors as JSON on standard output")
+
+// A key, as listed by key list or found by key find.
+type KeyResult struct {
+	// Known for keys in our key rings, not for keyserver results
+	Fingerprint string `json:"fingerprint,omitempty"`
+	KeyId string `json:"key_id"`
+	Algo string `json:"algo"`
+	// Known for keyserver results only
+	Bits int `json:"bits,omitempty"`
+	Uids []string `json:"uids,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// Key usage, some of S(ign), C(ertify) and E(ncrypt)
+	Capabilities string `json:"capabilities,omitempty"`
+	Revoked bool `json:"revoked,omitempty"`
+	Secret bool `json:"secret,omitempty"`
+	// Known for keys in our key rings: marked with key trust, or our own
+	Trusted bool `json:"trusted,omitempty"`
+	Subkeys []*KeyResult `json:"subkeys,omitempty"`
+}
+
+// A key written by key export.
+type ExportResult struct {
+	*KeyResult
+	// The public key, ASCII-armored
+	Armored string `json:"armored"`
+}
+
+// The agent, once it is listening.
+type AgentResult struct {
+	Socket string `json:"socket"`
+}
+
+// A paste read by get.
+type GetResult struct {
+	Signed bool `json:"signed"`
+	// Set if the paste is signed by a key in our key rings
+	Signer *KeyResult `json:"signer,omitempty"`
+	// IDs of the keys the paste is encrypted to
+	Recipients []string `json:"recipients"`
+	Symmetric bool `json:"symmetric"`
+	FileName string `json:"file_name,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+	Binary bool `json:"binary"`
+	// Paths written with -extract
+	Extracted []string `json:"extracted,omitempty"`
+	// The paste itself, base64 encoded, unless extracted
+	Content []byte `json:"content,omitempty"`
+}
+
+// Expired pastes removed by history -prune, and those kept because they
+// could not be deleted remotely.
+type PruneResult struct {
+	Pruned []string `json:"pruned"`
+	Failed []string `json:"failed,omitempty"`
+	Error *ErrorResult `json:"error,omitempty"`
+}
+
+// A paste or key removed by delete or key delete.
+type DeleteResult struct {
+	Deleted string `json:"deleted"`
+}
+
+// An error, printed instead of any result.
+type ErrorResult struct {
+	Error string `json:"error"`
+	// One of the names in errorKindNames, or "error"
+	Kind string `json:"kind"`
+	ExitCode int `json:"exit_code"`
+}
+
+var errorKindNames map[error]string = map[error]string{
+	ErrBadSignature: "bad_signature",
+	ErrUnknownSigner: "unknown_signer",
+	ErrUsage: "usage",
+	ErrNotFound: "not_found",
+	ErrDecryptFailed: "decrypt_failed",
+	ErrBadPassphrase: "bad_passphrase",
+	ErrUnknownRecipient: "unknown_recipient",
+	ErrRejected: "rejected",
+	ErrRateLimited: "rate_limited",
+	ErrNetwork: "network",
+	ErrInterrupted: "interrupted",
+}
+
+// Public key algorithm names, by OpenPGP algorithm number.
+var algoNames map[int]string = map[int]string{
+	1: "RSA",
+	2: "RSA-E",
+	3: "RSA-S",
+	16: "ElGamal",
+	17: "DSA",
+	18: "ECDH",
+	19: "ECDSA",
+	22: "EdDSA",
+}
+
+func algoName(algo int) string {
+	if name, has := algoNames[algo]; has {
+		return name
+	}
+	return fmt.Sprintf("%d", algo)
+}
+
+// Print a result as JSON on standard output.
+func writeJson(result interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(result)
+}
+
+// An error already printed as part of a -json result.
+type reportedError struct {
+	err error
+}
+
+func (e *reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reportedError) Kind() error {
+	return ErrorKind(e.err)
+}
+
+// Report an error that ended antipaste: as JSON on standard output with
+// -json, otherwise on standard error.
+func PrintError(err error) {
+	if !*jsonOutput {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	if _, reported := err.(*reportedError); !reported {
+		writeJson(errorResult(err))
+	}
+}
+
+func errorResult(err error) *ErrorResult {
+	kind, has := errorKindNames[ErrorKind(err)]
+	if !has {
+		kind = "error"
+	}
+	return &ErrorResult{ Error: err.Error(), Kind: kind, ExitCode: ExitCode(err) }
+}
+
+// Describe a key in our key rings.
+func entityKeyResult(entity *openpgp.Entity, secret bool) *KeyResult {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	result := &KeyResult{
+		Fingerprint: fingerprint,
+		KeyId: fmt.Sprintf("%016X", entity.PrimaryKey.KeyId),
+		Algo: algoName(int(entity.PrimaryKey.PubKeyAlgo)),
+		Uids: []string{},
+		Revoked: len(entity.Revocations) > 0,
+		Secret: secret }
+	created := entity.PrimaryKey.CreationTime
+	result.Created = &created
+	if ident, has := entity.Identities[primaryUid(entity)]; has {
+		if expiry, expires := keyExpiry(created, ident.SelfSignature); expires {
+			result.Expires = &expiry
+		}
+		result.Capabilities = capabilities(ident.SelfSignature)
+	}
+	for name, _ := range entity.Identities {
+		result.Uids = append(result.Uids, name)
+	}
+	sort.Strings(result.Uids)
+	for _, subkey := range entity.Subkeys {
+		subCreated := subkey.PublicKey.CreationTime
+		sub := &KeyResult{
+			KeyId: fmt.Sprintf("%016X", subkey.PublicKey.KeyId),
+			Algo: algoName(int(subkey.PublicKey.PubKeyAlgo)),
+			Created: &subCreated,
+			Capabilities: capabilities(subkey.Sig) }
+		if expiry, expires := keyExpiry(subCreated, subkey.Sig); expires {
+			sub.Expires = &expiry
+		}
+		result.Subkeys = append(result.Subkeys, sub)
+	}
+	return result
+}
+
+// Describe a key found on a keyserver.
+func hkpKeyResult(hkpResult *HkpResult) *KeyResult {
+	result := &KeyResult{
+		KeyId: hkpResult.KeyId,
+		Algo: algoName(hkpResult.Algo),
+		Bits: hkpResult.KeyLen,
+		Uids: []string{},
+		Created: hkpTime(hkpResult.CreationDate),
+		Expires: hkpTime(hkpResult.ExpirationDate),
+		Revoked: strings.Contains(hkpResult.Flags, "r") }
+	for _, uid := range hkpResult.Uids {
+		result.Uids = append(result.Uids, uid.Uid)
+	}
+	return result
+}
+
+// A keyserver date, in seconds since the epoch. Dates left out of a
+// keyserver response are parsed as 0 or all ones.
+func hkpTime(seconds uint64) *time.Time {
+	if seconds == 0 || seconds == 0xFFFFFFFFFFFFFFFF {
+		return nil
+	}
+	t := time.Unix(int64(seconds), 0).UTC()
+	return &t
+}
+
+// Describe a paste that has been read, given what was extracted from it or
+// else its content.
+func (pgp *Pgp) getResult(md *openpgp.MessageDetails, extracted []string, content []byte) *GetResult {
+	result := &GetResult{
+		Signed: md.IsSigned,
+		Recipients: []string{},
+		Symmetric: md.IsSymmetricallyEncrypted,
+		Extracted: extracted,
+		Content: content }
+	if md.SignedBy != nil {
+		result.Signer = entityKeyResult(md.SignedBy.Entity, false)
+		result.Signer.Trusted = pgp.isTrusted(md.SignedBy.Entity)
+	}
+	for _, keyId := range md.EncryptedToKeyIds {
+		result.Recipients = append(result.Recipients, fmt.Sprintf("%016X", keyId))
+	}
+	if md.LiteralData != nil {
+		result.FileName = md.LiteralData.FileName
+		result.Binary = md.LiteralData.IsBinary
+		if md.LiteralData.Time != 0 {
+			modTime := time.Unix(int64(md.LiteralData.Time), 0).UTC()
+			result.ModTime = &modTime
+		}
+	}
+	return result
+}
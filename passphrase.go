@@ -0,0 +1,206 @@
+package antipaste
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"github.com/cmars/go.crypto/openpgp"
+	"github.com/cmars/go.crypto/ssh/terminal"
+)
+
+// Name of an environment variable holding a pinentry-style command. The
+// command is run with the prompt as its only argument and must print the
+// passphrase on the first line of its standard output.
+const AskpassEnv = "ANTIPASTE_ASKPASS"
+
+// Number of times a passphrase is asked for before giving up on a key.
+const passphraseAttempts = 3
+
+var passphraseFd = flag.Int("passphrase-fd", -1, "Read passphrases from this file descriptor")
+
+// Returned when a secret key could not be unlocked with any passphrase given.
+var ErrBadPassphrase = errors.New("Bad passphrase")
+
+// Shared by all reads from -passphrase-fd, one passphrase per line.
+var passphraseReader *bufio.Reader
+
+// Whether passphrases are typed by a person, rather than read from a
+// descriptor or command.
+func interactivePassphrase() bool {
+	return *passphraseFd < 0 && os.Getenv(AskpassEnv) == ""
+}
+
+// Read a passphrase from -passphrase-fd, the $ANTIPASTE_ASKPASS command,
+// or the controlling terminal, in that order of preference.
+func readPassphrase(prompt string) ([]byte, error) {
+	if *passphraseFd >= 0 {
+		if passphraseReader == nil {
+			passphraseReader = bufio.NewReader(
+				os.NewFile(uintptr(*passphraseFd), "passphrase-fd"))
+		}
+		line, err := passphraseReader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	if askpass := os.Getenv(AskpassEnv); askpass != "" {
+		out, err := exec.Command(askpass, prompt).Output()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s failed: %v", AskpassEnv, err))
+		}
+		line := strings.SplitN(string(out), "\n", 2)[0]
+		return []byte(strings.TrimRight(line, "\r")), nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, newError(ErrUsage,
+			"No terminal to read a passphrase from, use -passphrase-fd or %s", AskpassEnv)
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "%s: ", prompt)
+	passphrase, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintf(tty, "\n")
+	return passphrase, err
+}
+
+// Read a new passphrase, asking twice when a person is typing it.
+// An empty passphrase leaves the key unprotected.
+func readNewPassphrase(prompt string) ([]byte, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil || !interactivePassphrase() {
+		return passphrase, err
+	}
+	confirm, err := readPassphrase("Repeat to confirm")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, newError(ErrBadPassphrase, "Passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// Describe a key for a passphrase prompt.
+func keyPrompt(entity *openpgp.Entity) string {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	return fmt.Sprintf("Passphrase for %s %s", fingerprint, primaryUid(entity))
+}
+
+// Whether any private key material in a secret key entity is still encrypted.
+func isLocked(entity *openpgp.Entity) bool {
+	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+		return true
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt the primary key and all subkeys of a secret key entity.
+func unlockWith(entity *openpgp.Entity, passphrase []byte) error {
+	if entity.PrivateKey != nil {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unlock a secret key entity, prompting for its passphrase if needed.
+// The passphrase is remembered so that Save can protect the key again.
+func (pgp *Pgp) unlock(entity *openpgp.Entity) error {
+	if !isLocked(entity) {
+		return nil
+	}
+	for i := 0; i < passphraseAttempts; i++ {
+		passphrase, err := readPassphrase(keyPrompt(entity))
+		if err != nil {
+			return err
+		}
+		if err = unlockWith(entity, passphrase); err == nil {
+			fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+			pgp.passphrases[fingerprint] = passphrase
+			return nil
+		}
+		if !interactivePassphrase() {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Bad passphrase, try again\n")
+	}
+	return ErrBadPassphrase
+}
+
+// PromptFunction for openpgp.ReadMessage. Unlocks the first candidate key
+// we can, after which ReadMessage retries decryption on its own. Failing
+// that, a passphrase is asked for if the message was encrypted with one.
+func (pgp *Pgp) prompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	err := newError(ErrDecryptFailed, "No secret key available to decrypt")
+	for _, key := range keys {
+		if err = pgp.unlock(key.Entity); err == nil {
+			return nil, nil
+		}
+	}
+	if !symmetric {
+		return nil, err
+	}
+	// ReadMessage asks again for as long as the passphrase is wrong
+	if pgp.symmetricAttempts > 0 {
+		if pgp.symmetricAttempts >= passphraseAttempts || !interactivePassphrase() {
+			return nil, ErrBadPassphrase
+		}
+		fmt.Fprintf(os.Stderr, "Bad passphrase, try again\n")
+	}
+	pgp.symmetricAttempts++
+	passphrase, err := readPassphrase("Paste passphrase")
+	pgp.symmetricPassphrase = passphrase
+	return passphrase, err
+}
+
+// Get the passphrase for a symmetrically encrypted paste. If none is given,
+// a random one is generated and shown.
+func pastePassphrase() ([]byte, error) {
+	passphrase, err := readNewPassphrase("Paste passphrase (empty to generate one)")
+	if err != nil || len(passphrase) > 0 {
+		return passphrase, err
+	}
+	random := make([]byte, 15)
+	if _, err = io.ReadFull(rand.Reader, random); err != nil {
+		return nil, err
+	}
+	passphrase = []byte(base64.URLEncoding.EncodeToString(random))
+	fmt.Fprintf(os.Stderr, "Paste passphrase: %s\n", passphrase)
+	return passphrase, nil
+}
+
+// Set a new passphrase on a secret key. It is applied the next time the
+// key ring is saved.
+func (pgp *Pgp) SetPassphrase(entity *openpgp.Entity, passphrase []byte) error {
+	if err := pgp.unlock(entity); err != nil {
+		return err
+	}
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	pgp.passphrases[fingerprint] = passphrase
+	return nil
+}
@@ -1,67 +1,159 @@
 package antipaste
 
 import (
-	"errors"
-	"flag"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
-var pbApiKey = flag.String("pb-api", "89f37b01f7f599990fef3e94fe7a570d", "Pastebin API key")
 var pbPrefix = regexp.MustCompile("^pb:")
 
 type PastebinHandler struct {
 	ApiKey string
+	UserKey string
+	Expire string
+	client *HttpClient
+}
+
+type pastebinExpiry struct {
+	ttl time.Duration
+	option string
+}
+
+// Expiry periods pastebin offers, shortest first.
+var pastebinExpiries []pastebinExpiry = []pastebinExpiry{
+	{ 10 * time.Minute, "10M" },
+	{ time.Hour, "1H" },
+	{ 24 * time.Hour, "1D" },
+	{ 7 * 24 * time.Hour, "1W" },
+	{ 14 * 24 * time.Hour, "2W" },
+	{ 30 * 24 * time.Hour, "1M" },
+	{ 182 * 24 * time.Hour, "6M" },
+	{ 365 * 24 * time.Hour, "1Y" },
 }
 
 func init() {
-	pbh := &PastebinHandler{ ApiKey: *pbApiKey }
-	protocolHandlers[pbh.Prefix()] = pbh
+	Register("pb", NewPastebinHandler,
+		HandlerOption{ "api", "89f37b01f7f599990fef3e94fe7a570d", "Pastebin API key" },
+		HandlerOption{ "user-key", "", "Pastebin user key, needed to delete pastes" })
+}
+
+func NewPastebinHandler(config *HandlerConfig) (ProtocolHandler, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return &PastebinHandler{
+		ApiKey: config.Get("api"),
+		UserKey: config.Get("user-key"),
+		Expire: "N",
+		client: client }, nil
+}
+
+// Pastebin only offers a few expiry periods, the longest one no longer
+// than ttl is used.
+func (pbh *PastebinHandler) SetExpiry(ttl time.Duration) (time.Duration, error) {
+	var applied pastebinExpiry
+	for _, expiry := range pastebinExpiries {
+		if expiry.ttl <= ttl {
+			applied = expiry
+		}
+	}
+	if applied.option == "" {
+		return 0, newError(ErrUsage, "Pastebin pastes can't expire sooner than %v", pastebinExpiries[0].ttl)
+	}
+	pbh.Expire = applied.option
+	return applied.ttl, nil
+}
+
+func (pbh *PastebinHandler) Expiry() time.Duration {
+	for _, expiry := range pastebinExpiries {
+		if expiry.option == pbh.Expire {
+			return expiry.ttl
+		}
+	}
+	return 0
 }
 
 func (pbh *PastebinHandler) Prefix() string {
 	return "pb"
 }
 
-func (pbh *PastebinHandler) ReadPaste(url string) (io.ReadCloser, error) {
+func (pbh *PastebinHandler) ReadPaste(ctx context.Context, url string) (io.ReadCloser, error) {
 	url = strings.Trim(url, "/")
 	fields := strings.Split(url, "/")
 	if len(fields) == 0 {
-		return nil, errors.New(fmt.Sprintf("Invalid pastebin paste URL %v", url))
+		return nil, newError(ErrUsage, "Invalid pastebin paste URL %v", url)
 	}
 	pbId := fields[len(fields)-1]
 	pbId = pbPrefix.ReplaceAllLiteralString(pbId, "")
-	resp, err := http.Get(fmt.Sprintf("http://pastebin.com/raw.php?i=%s", pbId))
+	resp, err := pbh.client.Get(ctx, fmt.Sprintf("http://pastebin.com/raw.php?i=%s", pbId))
 	if err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
-func (pbh *PastebinHandler) WritePaste(r io.Reader) (string, error) {
+func (pbh *PastebinHandler) WritePaste(ctx context.Context, r io.Reader) (string, error) {
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
-	resp, err := http.PostForm("http://pastebin.com/api/api_post.php",
+	resp, err := pbh.client.PostForm(ctx, "http://pastebin.com/api/api_post.php",
 		url.Values{
 			"api_option": {"paste"},
-			"api_dev_key": {*pbApiKey},
+			"api_dev_key": {pbh.ApiKey},
+			"api_user_key": {pbh.UserKey},
+			"api_paste_expire_date": {pbh.Expire},
 			"api_paste_code": {string(contents)}})
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 	url, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// Pastebin reports errors with a 200 OK
+	if strings.HasPrefix(string(url), "Bad API request") {
+		return "", newError(ErrRejected, "Pastebin: %s", string(url))
+	}
 	fields := strings.Split(string(url), "/")
 	id := fields[len(fields)-1]
 	if len(fields) < 2 {
-		return "", errors.New(fmt.Sprintf("Invalid response: %s", id))
+		return "", newError(ErrRejected, "Invalid response: %s", id)
 	}
 	return fmt.Sprintf("%s:%s", pbh.Prefix(), id), err
 }
+
+// Delete a paste. Only pastes made with the same user key can be deleted.
+func (pbh *PastebinHandler) DeletePaste(ctx context.Context, pasteUrl string) error {
+	if pbh.UserKey == "" {
+		return newError(ErrUsage, "Deleting pastebin pastes needs -pb-user-key")
+	}
+	fields := strings.Split(strings.Trim(pasteUrl, "/"), "/")
+	pbId := pbPrefix.ReplaceAllLiteralString(fields[len(fields)-1], "")
+	resp, err := pbh.client.PostForm(ctx, "http://pastebin.com/api/api_post.php",
+		url.Values{
+			"api_option": {"delete"},
+			"api_dev_key": {pbh.ApiKey},
+			"api_user_key": {pbh.UserKey},
+			"api_paste_key": {pbId}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(result)) != "Paste Removed" {
+		return newError(ErrRejected, "Pastebin: %s", string(result))
+	}
+	return nil
+}
@@ -1,14 +1,18 @@
 package antipaste
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"github.com/cmars/go.crypto/openpgp"
 	"github.com/cmars/go.crypto/openpgp/packet"
@@ -16,7 +20,7 @@ import (
 
 var homeFlag = flag.String("homedir", "", "Antipaste keyring home directory")
 
-var pgpBlockRE = regexp.MustCompile(`(?ms:-----BEGIN [^-]+-----.*-----END [^-]+-----)`)
+var pgpBlockRE = regexp.MustCompile(`(?ms:-----BEGIN [^-]+-----.*?-----END [^-]+-----)`)
 
 type Keyserver struct {
 	Hostname string
@@ -27,6 +31,17 @@ type Pgp struct {
 	SecRing openpgp.EntityList
 	PubRing openpgp.EntityList
 	Keyservers []Keyserver
+	// Passphrases of secret keys unlocked or created in this session,
+	// by fingerprint
+	passphrases map[string][]byte
+	// Secret key packets as loaded, by fingerprint
+	secPackets map[string][]byte
+	// Fingerprints of the keys marked as trusted with key trust
+	trusted map[string]bool
+	// Passphrases tried on a symmetrically encrypted message
+	symmetricAttempts int
+	// Passphrase last tried on a symmetrically encrypted message
+	symmetricPassphrase []byte
 }
 
 func FpToString(fp [20]byte) (string, error) {
@@ -51,30 +66,172 @@ func StringToFp(fpStr string) ([20]byte, error) {
 	return result, nil
 }
 
-func (pgp *Pgp) encrypt(ciphertext io.Writer,
-		recipients []*openpgp.Entity) (plaintext io.WriteCloser, err error) {
-	return openpgp.Encrypt(ciphertext, recipients, nil, nil, nil)
+// Encrypt content to recipients, signing with signer if it is not nil.
+// Content is compressed first with an algorithm all recipients accept.
+func (pgp *Pgp) encrypt(ciphertext io.Writer, recipients []*openpgp.Entity,
+		signer *openpgp.Entity, hints *openpgp.FileHints) (plaintext io.WriteCloser, err error) {
+	config, err := compressionConfig(recipients)
+	if err != nil {
+		return nil, err
+	}
+	if config.DefaultCompressionAlgo == packet.CompressionNone {
+		return openpgp.Encrypt(ciphertext, recipients, signer, hints, config)
+	}
+	return encryptCompressed(ciphertext, recipients, signer, hints, config)
 }
 
-// Decrypt content using a private key in our keyring.
-func (pgp *Pgp) decrypt(r io.Reader) (io.Reader, error) {
-	md, err := openpgp.ReadMessage(r, pgp.SecRing, nil, nil)
+// Encrypt content with a passphrase alone. Such pastes are not signed.
+func (pgp *Pgp) encryptSymmetric(ciphertext io.Writer, passphrase []byte,
+		hints *openpgp.FileHints) (plaintext io.WriteCloser, err error) {
+	config, err := compressionConfig(nil)
 	if err != nil {
 		return nil, err
 	}
-	return md.UnverifiedBody, nil
+	return openpgp.SymmetricallyEncrypt(ciphertext, passphrase, hints, config)
+}
+
+// Decrypt content encrypted with a known passphrase, such as a -link key.
+func (pgp *Pgp) decryptWithPassphrase(r io.Reader,
+		passphrase []byte) (md *openpgp.MessageDetails, err error) {
+	tried := false
+	return openpgp.ReadMessage(r, pgp.keyRing(), func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried || !symmetric {
+			return nil, ErrBadPassphrase
+		}
+		tried = true
+		return passphrase, nil
+	}, nil)
+}
+
+// Decrypt content using a private key in our keyring, or held by the agent
+// if one is running. The signature, if any, is checked against both key
+// rings, but only once md.UnverifiedBody has been read to EOF.
+func (pgp *Pgp) decrypt(r io.Reader) (md *openpgp.MessageDetails, err error) {
+	if client, err := dialAgent(); err == nil {
+		defer client.Close()
+		return pgp.decryptWithAgent(client, r)
+	}
+	return openpgp.ReadMessage(r, pgp.keyRing(), pgp.prompt, nil)
+}
+
+// Secret and public keys combined, secret keys first so that decryption
+// finds the private key material before a public copy of the same key.
+func (pgp *Pgp) keyRing() openpgp.EntityList {
+	keyring := openpgp.EntityList{}
+	keyring = append(keyring, pgp.SecRing...)
+	keyring = append(keyring, pgp.PubRing...)
+	return keyring
+}
+
+// Resolve a secret key as recipients are resolved. An empty id selects
+// the first secret key, or none if there are no secret keys.
+func (pgp *Pgp) resolveSigner(id string) (*openpgp.Entity, error) {
+	if id == "" {
+		if len(pgp.SecRing) == 0 {
+			return nil, nil
+		}
+		return pgp.SecRing[0], nil
+	}
+	matches := matchKeys(pgp.SecRing, id)
+	switch len(matches) {
+	case 0:
+		return nil, newError(ErrNotFound, "Secret key not found: %s", id)
+	case 1:
+		for _, entity := range matches {
+			return entity, nil
+		}
+	}
+	return nil, newError(ErrUsage, "Ambiguous secret key %s matches:\n%s", id, listCandidates(matches))
+}
+
+// Get the primary user ID of an entity, or any user ID if none is marked primary.
+func primaryUid(entity *openpgp.Entity) string {
+	uid := ""
+	for name, ident := range entity.Identities {
+		if ident.SelfSignature != nil && ident.SelfSignature.IsPrimaryId != nil &&
+				*ident.SelfSignature.IsPrimaryId {
+			return name
+		}
+		if uid == "" || name < uid {
+			uid = name
+		}
+	}
+	return uid
 }
 
-// Resolve a recipient by key ID, email address, etc.
-func (pgp *Pgp) resolveRecipient(id string) *openpgp.Entity {
+// Resolve a recipient by fingerprint suffix or by a substring of a user ID
+// name or email address. An id matching more than one key is an error
+// listing the candidates.
+func (pgp *Pgp) resolveRecipient(recipient string) (*openpgp.Entity, error) {
+	matches := matchKeys(pgp.PubRing, recipient)
+	switch len(matches) {
+	case 0:
+		return nil, newError(ErrUnknownRecipient, "Recipient not found: %s", recipient)
+	case 1:
+		for _, entity := range matches {
+			return entity, nil
+		}
+	}
+	return nil, newError(ErrUnknownRecipient, "Ambiguous recipient %s matches:\n%s",
+		recipient, listCandidates(matches))
+}
+
+// Find the keys in a key ring matching an id. An id prefixed with 0x is a
+// fingerprint suffix; one of at least 8 hex digits matches by fingerprint
+// suffix or user ID, and anything shorter by user ID only, so that names
+// like "ed" don't pick a key by fingerprint. The matches are keyed by
+// fingerprint.
+func matchKeys(keyring openpgp.EntityList, id string) map[string]*openpgp.Entity {
 	id = strings.ToLower(id)
-	for _, entity := range pgp.PubRing {
+	byFp, byUid := isHex(id) && len(id) >= 8, true
+	if strings.HasPrefix(id, "0x") && isHex(id[2:]) {
+		id = id[2:]
+		byFp, byUid = true, false
+	}
+	matches := make(map[string]*openpgp.Entity)
+	for _, entity := range keyring {
 		fp, _ := FpToString(entity.PrimaryKey.Fingerprint)
-		if strings.HasSuffix(fp, id) {
-			return entity
+		if (byFp && strings.HasSuffix(fp, id)) || (byUid && uidMatches(entity, id)) {
+			matches[fp] = entity
 		}
 	}
-	return nil
+	return matches
+}
+
+// Whether a lower-cased id is made of hex digits only.
+func isHex(id string) bool {
+	return id != "" && strings.Trim(id, "0123456789abcdef") == ""
+}
+
+// List the keys an ambiguous id matches, one a line.
+func listCandidates(matches map[string]*openpgp.Entity) string {
+	candidates := []string{}
+	for fp, entity := range matches {
+		candidates = append(candidates, fmt.Sprintf("  %s %s", fp, primaryUid(entity)))
+	}
+	sort.Strings(candidates)
+	return strings.Join(candidates, "\n")
+}
+
+// Whether a recipient id matches any public key, whether or not it
+// resolves to a single one.
+func (pgp *Pgp) matchesRecipient(recipient string) bool {
+	return len(matchKeys(pgp.PubRing, recipient)) > 0
+}
+
+// Whether the lower-cased id is part of the name or email address of any
+// of an entity's user IDs.
+func uidMatches(entity *openpgp.Entity, id string) bool {
+	for _, ident := range entity.Identities {
+		if ident.UserId == nil {
+			continue
+		}
+		if strings.Contains(strings.ToLower(ident.UserId.Name), id) ||
+				strings.Contains(strings.ToLower(ident.UserId.Email), id) {
+			return true
+		}
+	}
+	return false
 }
 
 func homeDir() (string, error) {
@@ -99,40 +256,49 @@ func keyFiles() (pubFile string, secFile string, err error) {
 }
 
 func (pgp *Pgp) Load() error {
+	pgp.passphrases = make(map[string][]byte)
+	pgp.secPackets = make(map[string][]byte)
+	pgp.trusted = make(map[string]bool)
+	pgp.PubRing = []*openpgp.Entity{}
+	pgp.SecRing = []*openpgp.Entity{}
 	pubFile, secFile, err := keyFiles()
 	if err != nil {
 		return err
 	}
 	// Read the public key ring
-	_, err = os.Stat(pubFile)
-	if err == os.ErrNotExist {
-		pgp.PubRing = []*openpgp.Entity{}
-	} else if err == nil {
-		pubReader, err := os.Open(pubFile)
-		if err != nil {
-			return err
-		}
+	pubReader, err := os.Open(pubFile)
+	if err == nil {
 		defer pubReader.Close()
 		pgp.PubRing, err = openpgp.ReadKeyRing(pubReader)
 		if err != nil {
 			return err
 		}
-	} else {
+	} else if !os.IsNotExist(err) {
 		return err
 	}
 	// Read the private key ring
-	_, err = os.Stat(secFile)
-	if err == os.ErrNotExist {
-		pgp.SecRing = []*openpgp.Entity{}
-	} else if err == nil {
-		secReader, err := os.Open(secFile)
+	secData, err := ioutil.ReadFile(secFile)
+	if err == nil {
+		pgp.SecRing, err = openpgp.ReadKeyRing(bytes.NewBuffer(secData))
 		if err != nil {
 			return err
 		}
-		defer secReader.Close()
-		pgp.SecRing, err = openpgp.ReadKeyRing(secReader)
+		// Keep the packets of keys that may stay locked, so that
+		// they can be saved again without their passphrase
+		if pgp.secPackets, err = splitSecRing(secData); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
 	}
-	return err
+	// Read the trusted keys last, so that the rings are loaded even
+	// if the trust file is bad
+	trusted, err := loadTrust()
+	if err != nil {
+		return err
+	}
+	pgp.trusted = trusted
+	return nil
 }
 
 func (pgp *Pgp) Save() error {
@@ -159,7 +325,7 @@ func (pgp *Pgp) Save() error {
 	}
 	defer secWriter.Close()
 	for _, e := range pgp.SecRing {
-		err = e.SerializePrivate(secWriter, nil)
+		err = pgp.serializeSecret(secWriter, e)
 		if err != nil {
 			return err
 		}
@@ -167,7 +333,10 @@ func (pgp *Pgp) Save() error {
 	return err
 }
 
-func (pgp *Pgp) GenKey(name string, email string, comment string) (*openpgp.Entity, error) {
+// Generate a new key pair, protected by passphrase when the key ring is
+// saved. An empty passphrase leaves the secret key unprotected.
+func (pgp *Pgp) GenKey(name string, email string, comment string,
+		passphrase []byte) (*openpgp.Entity, error) {
 	config := &packet.Config{}
 	entity, err := openpgp.NewEntity(name, comment, email, config)
 	if err != nil {
@@ -190,6 +359,8 @@ func (pgp *Pgp) GenKey(name string, email string, comment string) (*openpgp.Enti
 		pubSubkey := &openpgp.Subkey{ PublicKey: subkey.PublicKey, Sig: subkey.Sig }
 		pubEntity.Subkeys = append(pubEntity.Subkeys, *pubSubkey)
 	}
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	pgp.passphrases[fingerprint] = passphrase
 	pgp.SecRing = append(pgp.SecRing, entity)
 	pgp.PubRing = append(pgp.PubRing, entity)
 	return pubEntity, err
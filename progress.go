@@ -0,0 +1,119 @@
+package antipaste
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var showProgress = flag.Bool("progress", stderrIsTerminal(), "Report bytes encrypted, uploaded, downloaded and decrypted by put and get on standard error")
+
+// No progress is shown for transfers over sooner than this.
+const progressDelay = 500 * time.Millisecond
+
+// Shortest time between redraws of the progress line.
+const progressInterval = 200 * time.Millisecond
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+// Reports the bytes passing through each stage of a put or get, on a line
+// redrawn in place.
+type Progress struct {
+	w io.Writer
+	enabled bool
+	stages []*progressStage
+	started time.Time
+	drawn time.Time
+	// Length of the line last drawn, zero if there is none to finish
+	width int
+	mu sync.Mutex
+}
+
+// Counts the bytes written to it for one stage. Tee a reader into it, or
+// write to it alongside a writer.
+type progressStage struct {
+	progress *Progress
+	name string
+	n int64
+}
+
+func NewProgress(w io.Writer, enabled bool) *Progress {
+	return &Progress{ w: w, enabled: enabled, started: time.Now() }
+}
+
+// The counter for a named stage, added after those before it.
+func (p *Progress) stage(name string) *progressStage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, stage := range p.stages {
+		if stage.name == name {
+			return stage
+		}
+	}
+	stage := &progressStage{ progress: p, name: name }
+	p.stages = append(p.stages, stage)
+	return stage
+}
+
+func (ps *progressStage) Write(b []byte) (int, error) {
+	p := ps.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps.n += int64(len(b))
+	now := time.Now()
+	if p.enabled && now.Sub(p.started) >= progressDelay && now.Sub(p.drawn) >= progressInterval {
+		p.draw()
+		p.drawn = now
+	}
+	return len(b), nil
+}
+
+// Redraw the progress line. Called with the lock held.
+func (p *Progress) draw() {
+	parts := []string{}
+	for _, stage := range p.stages {
+		parts = append(parts, fmt.Sprintf("%s %s", stage.name, formatBytes(stage.n)))
+	}
+	line := strings.Join(parts, ", ")
+	padding := ""
+	if len(line) < p.width {
+		padding = strings.Repeat(" ", p.width - len(line))
+	}
+	fmt.Fprintf(p.w, "\r%s%s", line, padding)
+	p.width = len(line)
+}
+
+// Draw the final counts and end the progress line, if one was started,
+// so that other messages can follow. Safe to call more than once.
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.width == 0 {
+		return
+	}
+	p.draw()
+	fmt.Fprintf(p.w, "\n")
+	p.width = 0
+}
+
+// Format a byte count with a binary unit.
+func formatBytes(n int64) string {
+	units := []string{ "KiB", "MiB", "GiB", "TiB" }
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units) - 1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,214 @@
+package antipaste
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"github.com/cmars/go.crypto/openpgp"
+	pgperrors "github.com/cmars/go.crypto/openpgp/errors"
+	"github.com/cmars/go.crypto/openpgp/packet"
+	"github.com/cmars/go.crypto/openpgp/s2k"
+)
+
+// OpenPGP constants used to protect secret keys, see RFC 4880.
+const (
+	tagSecretKey = 5
+	tagSecretSubkey = 7
+	s2kUsageSha1 = 254
+	s2kIteratedSalted = 3
+	hashIdSha1 = 2
+	cipherIdAes128 = 7
+	// Encodes an iteration count of 4194304 bytes
+	s2kCountByte = 0xC0
+)
+
+// Records everything read through it until stopped, so the raw bytes of
+// each packet can be recovered.
+type recordingReader struct {
+	r io.Reader
+	buf bytes.Buffer
+	stopped bool
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.stopped {
+		rr.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// Split a secret key ring into the raw packets of each entity, keyed by
+// fingerprint. Keys we cannot unlock are written back from these verbatim.
+func splitSecRing(data []byte) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	rr := &recordingReader{ r: bytes.NewBuffer(data) }
+	current := ""
+	for {
+		p, err := packet.Read(rr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			switch err.(type) {
+			case pgperrors.UnsupportedError, pgperrors.UnknownPacketTypeError:
+				;
+			default:
+				return nil, err
+			}
+		}
+		if pk, is := p.(*packet.PrivateKey); is && !pk.IsSubkey {
+			current, _ = FpToString(pk.Fingerprint)
+		}
+		if current != "" {
+			result[current] = append(result[current], rr.buf.Bytes()...)
+		}
+		rr.buf.Reset()
+	}
+	return result, nil
+}
+
+// Write a secret key entity, protecting it with its passphrase if it has one.
+func (pgp *Pgp) serializeSecret(w io.Writer, entity *openpgp.Entity) error {
+	fingerprint, _ := FpToString(entity.PrimaryKey.Fingerprint)
+	if isLocked(entity) {
+		// Never unlocked, write it back as it was read
+		raw, has := pgp.secPackets[fingerprint]
+		if !has {
+			return errors.New(fmt.Sprintf("Cannot save locked secret key %s", fingerprint))
+		}
+		_, err := w.Write(raw)
+		return err
+	}
+	passphrase := pgp.passphrases[fingerprint]
+	if len(passphrase) == 0 {
+		return entity.SerializePrivate(w, nil)
+	}
+	err := serializeLockedKey(w, entity.PrivateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	for _, ident := range entity.Identities {
+		if err = ident.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err = ident.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err = serializeLockedKey(w, subkey.PrivateKey, passphrase); err != nil {
+			return err
+		}
+		if err = subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a secret key packet with its key material encrypted under the
+// passphrase: AES-128 with an iterated and salted SHA-1 S2K, and a SHA-1
+// checksum, as GnuPG does.
+func serializeLockedKey(w io.Writer, pk *packet.PrivateKey, passphrase []byte) error {
+	plainBuf := bytes.NewBuffer(nil)
+	if err := pk.Serialize(plainBuf); err != nil {
+		return err
+	}
+	pubBuf := bytes.NewBuffer(nil)
+	if err := pk.PublicKey.Serialize(pubBuf); err != nil {
+		return err
+	}
+	body, err := packetBody(plainBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	pubBody, err := packetBody(pubBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	// body is the public key, a zero S2K usage byte, the secret key
+	// material and a two-byte checksum
+	if len(body) < len(pubBody) + 3 || body[len(pubBody)] != 0 {
+		return errors.New("Unexpected secret key encoding")
+	}
+	secret := body[len(pubBody)+1 : len(body)-2]
+
+	salt := make([]byte, 8)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	s2k.Iterated(key, sha1.New(), passphrase, salt, s2kCount(s2kCountByte))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	h.Write(secret)
+	encrypted := append(append([]byte{}, secret...), h.Sum(nil)...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, encrypted)
+
+	out := bytes.NewBuffer(nil)
+	out.Write(pubBody)
+	out.Write([]byte{ s2kUsageSha1, cipherIdAes128, s2kIteratedSalted, hashIdSha1 })
+	out.Write(salt)
+	out.WriteByte(s2kCountByte)
+	out.Write(iv)
+	out.Write(encrypted)
+	tag := byte(tagSecretKey)
+	if pk.IsSubkey {
+		tag = tagSecretSubkey
+	}
+	if err = writePacketHeader(w, tag, out.Len()); err != nil {
+		return err
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// Decode an S2K iteration count, RFC 4880 section 3.7.1.3.
+func s2kCount(c byte) int {
+	return (16 + int(c & 15)) << (uint32(c >> 4) + 6)
+}
+
+// Strip the header from a single serialized new-format packet.
+func packetBody(p []byte) ([]byte, error) {
+	if len(p) < 2 || p[0] & 0xC0 != 0xC0 {
+		return nil, errors.New("Unexpected packet header")
+	}
+	switch {
+	case p[1] < 192:
+		return p[2:], nil
+	case p[1] < 224 && len(p) >= 3:
+		return p[3:], nil
+	case p[1] == 255 && len(p) >= 6:
+		return p[6:], nil
+	}
+	return nil, errors.New("Unexpected packet length")
+}
+
+// Write a new-format packet header, RFC 4880 section 4.2.
+func writePacketHeader(w io.Writer, tag byte, length int) error {
+	var header []byte
+	switch {
+	case length < 192:
+		header = []byte{ 0xC0 | tag, byte(length) }
+	case length < 8384:
+		length -= 192
+		header = []byte{ 0xC0 | tag, byte(192 + (length >> 8)), byte(length) }
+	default:
+		header = []byte{ 0xC0 | tag, 255, byte(length >> 24), byte(length >> 16),
+			byte(length >> 8), byte(length) }
+	}
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,88 @@
+package antipaste
+
+import (
+	"bytes"
+	"testing"
+	"github.com/cmars/go.crypto/openpgp"
+)
+
+func TestLockedKeyRoundTrip(t *testing.T) {
+	pgp := &Pgp{ passphrases: make(map[string][]byte), secPackets: make(map[string][]byte) }
+	passphrase := []byte("correct horse")
+	entity, err := pgp.GenKey("Alice", "alice@example.com", "", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = pgp.serializeSecret(buf, pgp.SecRing[0]); err != nil {
+		t.Fatal(err)
+	}
+	// A 2048 bit RSA secret key is too long for a one-octet packet length
+	if buf.Bytes()[1] < 192 {
+		t.Fatalf("secret key packet used a one-octet length %d", buf.Bytes()[1])
+	}
+	data := buf.Bytes()
+	for _, test := range []struct {
+		passphrase []byte
+		ok bool
+	}{
+		{ passphrase, true },
+		{ []byte("wrong"), false },
+	} {
+		entities, err := openpgp.ReadKeyRing(bytes.NewBuffer(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entities) != 1 {
+			t.Fatalf("read %d keys", len(entities))
+		}
+		read := entities[0]
+		if read.PrimaryKey.Fingerprint != entity.PrimaryKey.Fingerprint {
+			t.Fatal("fingerprint changed")
+		}
+		if !read.PrivateKey.Encrypted || len(read.Subkeys) != 1 || !read.Subkeys[0].PrivateKey.Encrypted {
+			t.Fatal("secret keys were not written locked")
+		}
+		err = read.PrivateKey.Decrypt(test.passphrase)
+		if test.ok && err != nil {
+			t.Fatalf("decrypting with the right passphrase: %v", err)
+		} else if !test.ok && err == nil {
+			t.Fatal("decrypted with a wrong passphrase")
+		}
+		if test.ok {
+			if err = read.Subkeys[0].PrivateKey.Decrypt(test.passphrase); err != nil {
+				t.Fatalf("decrypting subkey: %v", err)
+			}
+		}
+	}
+}
+
+func TestPacketHeaderLengths(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		headerLen int
+	}{
+		{ 0, 2 },
+		{ 191, 2 },
+		{ 192, 3 },
+		{ 8383, 3 },
+		{ 8384, 6 },
+		{ 100000, 6 },
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := writePacketHeader(buf, tagSecretKey, test.length); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != test.headerLen {
+			t.Fatalf("length %d: header of %d bytes, want %d", test.length, buf.Len(), test.headerLen)
+		}
+		buf.Write(make([]byte, test.length))
+		body, err := packetBody(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != test.length {
+			t.Fatalf("length %d: body of %d bytes", test.length, len(body))
+		}
+	}
+}